@@ -0,0 +1,42 @@
+// Package loop runs the background jobs of workers and managers, which
+// react to signals and otherwise reconcile periodically.
+package loop
+
+import (
+	"context"
+	"time"
+)
+
+// Signal wakes up a loop before its period elapsed. Notifications sent
+// while the loop is busy coalesce into one, and a nil Signal never fires.
+type Signal chan struct{}
+
+func NewSignal() Signal {
+	return make(Signal, 1)
+}
+
+// Notify wakes up the loop waiting on s without blocking.
+func (s Signal) Notify() {
+	select {
+	case s <- struct{}{}:
+	default:
+	}
+}
+
+// Run calls fn right away and then again whenever wake fires or at the
+// latest once period elapsed, until ctx is done. Without a positive period
+// fn only runs again when woken.
+func Run(ctx context.Context, period time.Duration, wake Signal, fn func()) {
+	for ctx.Err() == nil {
+		fn()
+		var tick <-chan time.Time
+		if period > 0 {
+			tick = time.After(period)
+		}
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package loop
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunWakesOnSignal(test *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wake := NewSignal()
+	calls := make(chan int, 10)
+	done := make(chan struct{})
+
+	n := 0
+	go func() {
+		Run(ctx, time.Hour, wake, func() {
+			n++
+			calls <- n
+		})
+		close(done)
+	}()
+
+	if <-calls != 1 {
+		test.Fatalf("Expected fn to run right away")
+	}
+	wake.Notify()
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		test.Fatalf("Expected fn to run after a signal")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		test.Fatalf("Expected loop to stop once the context is done")
+	}
+}
+
+func TestRunReconcilesPeriodically(test *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	n := 0
+	Run(ctx, 10*time.Millisecond, nil, func() { n++ })
+	if n < 3 {
+		test.Fatalf("Expected several runs, got %d", n)
+	}
+}
+
+func TestNotifyCoalesces(test *testing.T) {
+	s := NewSignal()
+	s.Notify()
+	s.Notify()
+	if len(s) != 1 {
+		test.Fatalf("Expected one pending notification, got %d", len(s))
+	}
+	var nilSignal Signal
+	nilSignal.Notify()
+}
@@ -1,18 +1,36 @@
 package main
 
 import (
+	"context"
 	"dumch/cube/manager"
+	"dumch/cube/node"
+	"dumch/cube/stats"
 	"dumch/cube/task"
 	"dumch/cube/worker"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
 	"strconv"
-
-	"github.com/golang-collections/collections/queue"
-	"github.com/google/uuid"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
+	// Stop on Ctrl-C or SIGTERM, letting background jobs finish first.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	background := func(job func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(ctx)
+		}()
+	}
+
 	whost := os.Getenv("CUBE_WORKER_HOST")
 	wport, _ := strconv.Atoi(os.Getenv("CUBE_WORKER_PORT"))
 	fmt.Printf("Worker host:port -> %s:%d", whost, wport)
@@ -22,31 +40,117 @@ func main() {
 
 	fmt.Println("Starting Cube worker")
 
-	w := worker.Worker{
-		Queue: *queue.New(),
-		Db:    make(map[uuid.UUID]*task.Task),
+	rt, err := task.NewDocker()
+	if err != nil {
+		log.Fatalf("Error creating container runtime: %v\n", err)
+	}
+	w, err := worker.New(fmt.Sprintf("worker-%d", wport), os.Getenv("CUBE_WORKER_DB"), rt)
+	if err != nil {
+		log.Fatalf("Error creating worker: %v\n", err)
+	}
+	resolution, err := time.ParseDuration(os.Getenv("CUBE_STATS_RESOLUTION"))
+	if err != nil {
+		resolution = worker.DefaultStatsResolution
+	}
+	retention, err := time.ParseDuration(os.Getenv("CUBE_STATS_RETENTION"))
+	if err != nil {
+		retention = worker.DefaultStatsRetention
+	}
+	if history, err := stats.NewHistory(resolution, retention); err != nil {
+		log.Printf("Invalid stats history settings, using defaults: %v\n", err)
+	} else {
+		w.History = history
+	}
+	if root := os.Getenv("CUBE_PROCFS_ROOT"); root != "" {
+		stats.SetProcFS(stats.ProcFS{Root: root})
+	}
+	if concurrency, err := strconv.Atoi(os.Getenv("CUBE_WORKER_CONCURRENCY")); err == nil {
+		w.Concurrency = concurrency
+	}
+	if ports := os.Getenv("CUBE_WORKER_PORTS"); ports != "" {
+		w.PortRange, err = worker.ParsePortRange(ports)
+		if err != nil {
+			log.Fatalf("Error parsing CUBE_WORKER_PORTS: %v\n", err)
+		}
 	}
-	wapi := worker.Api{Address: whost, Port: wport, Worker: &w}
+	if paths := os.Getenv("CUBE_WORKER_BIND_PATHS"); paths != "" {
+		w.AllowedBindPaths = strings.Split(paths, ",")
+	}
+	if path := os.Getenv("CUBE_REGISTRY_AUTH_FILE"); path != "" {
+		w.Registries, err = worker.LoadRegistryAuths(path)
+		if err != nil {
+			log.Fatalf("Error loading registry credentials: %v\n", err)
+		}
+	}
+	if high, err := strconv.ParseFloat(os.Getenv("CUBE_IMAGE_GC_HIGH"), 64); err == nil {
+		w.ImageGCHighThreshold = high
+	}
+	if low, err := strconv.ParseFloat(os.Getenv("CUBE_IMAGE_GC_LOW"), 64); err == nil {
+		w.ImageGCLowThreshold = low
+	}
+	wapi := worker.Api{Address: whost, Port: wport, Worker: w}
+
+	background(w.RunTasks)
+	background(w.UpdateTasks)
+	background(w.CollectStats)
+	background(w.GarbageCollectImages)
+	background(wapi.Start)
 
-	go w.RunTasks()
-	go w.CollectStats()
-	go wapi.Start()
+	waddr := fmt.Sprintf("%s:%d", whost, wport)
+	murl := fmt.Sprintf("http://%s:%d", mhost, mport)
+	n := node.NewNode(waddr, fmt.Sprintf("http://%s", waddr), "worker")
+	background(func(ctx context.Context) {
+		w.Heartbeat(ctx, murl, *n, 10*time.Second)
+	})
 
 	fmt.Println("Starting Cube manager")
 
-	workers := []string{fmt.Sprintf("%s:%d", whost, wport)}
+	// Workers register themselves, CUBE_WORKERS only lists extra static ones.
+	var workers []string
+	if static := os.Getenv("CUBE_WORKERS"); static != "" {
+		workers = strings.Split(static, ",")
+	}
 	fmt.Printf("Workers: %v", workers)
-	m := manager.New(workers)
+	m, err := manager.New(workers, os.Getenv("CUBE_SCHEDULER"), os.Getenv("CUBE_MANAGER_DB"))
+	if err != nil {
+		log.Fatalf("Error creating manager: %v\n", err)
+	}
+	if maxRestarts, err := strconv.Atoi(os.Getenv("CUBE_MAX_RESTARTS")); err == nil {
+		m.MaxRestarts = maxRestarts
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("CUBE_RESTART_BACKOFF")); err == nil {
+		m.RestartBackoff = backoff
+	}
 	mapi := manager.Api{Address: mhost, Port: mport, Manager: m}
 
-	go m.ProcessTasks()
-	go m.UpdateTasks()
-	mapi.Start()
+	background(m.ProcessTasks)
+	background(m.UpdateTasks)
+	background(m.UpdateNodeStats)
+	background(m.DoHealthChecks)
+	background(m.CheckNodes)
+	mapi.Start(ctx)
+
+	wg.Wait()
+	fmt.Println("Stopped Cube")
 }
 
 /*
 export CUBE_WORKER_HOST=localhost
 export CUBE_WORKER_PORT=5555 
+export CUBE_WORKER_DB=persistent
+export CUBE_STATS_RESOLUTION=15s
+export CUBE_STATS_RETENTION=1h
+export CUBE_PROCFS_ROOT=/proc
+export CUBE_WORKER_CONCURRENCY=4
+export CUBE_WORKER_PORTS=30000-32767
+export CUBE_WORKER_BIND_PATHS=/srv/cube
+export CUBE_REGISTRY_AUTH_FILE=~/.docker/config.json
+export CUBE_IMAGE_GC_HIGH=85
+export CUBE_IMAGE_GC_LOW=80
 export CUBE_MANAGER_HOST=localhost 
 export CUBE_MANAGER_PORT=5556 
+export CUBE_SCHEDULER=epvm
+export CUBE_MANAGER_DB=persistent
+export CUBE_MAX_RESTARTS=3
+export CUBE_RESTART_BACKOFF=10s
 */
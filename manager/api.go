@@ -1,7 +1,10 @@
 package manager
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -25,12 +28,44 @@ func (a *Api) initRouter() {
 		r.Post("/", a.StartTaskHandler)
 		r.Get("/", a.GetTasksHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
+			r.Get("/", a.GetTaskHandler)
 			r.Delete("/", a.StopTaskHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Post("/exec", a.ExecTaskHandler)
+			r.Get("/exec/ws", a.ExecTaskHandler)
 		})
 	})
+	a.Router.Route("/nodes", func(r chi.Router) {
+		r.Post("/", a.RegisterNodeHandler)
+		r.Get("/", a.GetNodesHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Get("/", a.GetNodeHandler)
+			r.Post("/heartbeat", a.HeartbeatHandler)
+		})
+	})
+	a.Router.Handle("/metrics", a.Manager.MetricsHandler())
+}
+
+// Handler returns the api's router, e.g. to serve it from a test server.
+func (a *Api) Handler() http.Handler {
+	if a.Router == nil {
+		a.initRouter()
+	}
+	return a.Router
 }
 
-func (a *Api) Start() {
-	a.initRouter()
-	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
+// Start serves the api until ctx is done.
+func (a *Api) Start(ctx context.Context) {
+	server := http.Server{
+		Addr:    fmt.Sprintf("%s:%d", a.Address, a.Port),
+		Handler: a.Handler(),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error serving manager api: %v\n", err)
+	}
 }
@@ -1,12 +1,14 @@
 package manager
 
 import (
+	"dumch/cube/node"
+	"dumch/cube/stats"
 	"dumch/cube/task"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -28,6 +30,28 @@ func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(e)
 		return
 	}
+	if err := te.Task.Validate(); err != nil {
+		msg := fmt.Sprintf("Invalid task: %v\n", err)
+		log.Printf(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		e := ErrResponse{
+			HTTPStatusCode: http.StatusBadRequest,
+			Message:        msg,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if err := a.Manager.Admit(te.Task); err != nil {
+		msg := fmt.Sprintf("Task not admitted: %v\n", err)
+		log.Printf(msg)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		e := ErrResponse{
+			HTTPStatusCode: http.StatusUnprocessableEntity,
+			Message:        msg,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
 
 	a.Manager.AddTask(te)
 	log.Printf("Added task %v\n", te.Task.ID)
@@ -41,6 +65,19 @@ func (a *Api) GetTasksHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(a.Manager.GetTasks())
 }
 
+func (a *Api) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskID, _ := uuid.Parse(chi.URLParam(r, "taskID"))
+	t, err := a.Manager.GetTask(taskID)
+	if err != nil {
+		log.Printf("No task with ID %v found", taskID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(t)
+}
+
 func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	taskIdParam := chi.URLParam(r, "taskID")
 	if taskIdParam == "" {
@@ -50,22 +87,79 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	taskID, _ := uuid.Parse(taskIdParam)
-	taskToStop, ok := a.Manager.TaskDb[taskID]
-	if !ok {
+	if err := a.Manager.StopTask(taskID); err != nil {
 		log.Printf("No task with ID %v found", taskID)
 		w.WriteHeader(404)
 		return
 	}
+	w.WriteHeader(204)
+}
 
-	te := task.TaskEvent{
-		ID:        uuid.New(),
-		State:     task.Completed,
-		Timestamp: time.Now(),
+func (a *Api) RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	n := node.Node{}
+	err := json.NewDecoder(r.Body).Decode(&n)
+	if err == nil && n.Name == "" {
+		err = errors.New("node name is required")
 	}
-	taskCopy := *taskToStop
-	taskCopy.State = task.Completed
-	te.Task = taskCopy
-	a.Manager.AddTask(te)
-	log.Printf("Added task event %v to stop task %v\n", te.ID, taskToStop.ID)
-	w.WriteHeader(204)
+	if err != nil {
+		msg := fmt.Sprintf("Error unmarshalling body: %v\n", err)
+		log.Printf(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		e := ErrResponse{
+			HTTPStatusCode: http.StatusBadRequest,
+			Message:        msg,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	a.Manager.RegisterNode(&n)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(n)
+}
+
+func (a *Api) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	s := stats.Stats{}
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		msg := fmt.Sprintf("Error unmarshalling body: %v\n", err)
+		log.Printf(msg)
+		w.WriteHeader(http.StatusBadRequest)
+		e := ErrResponse{
+			HTTPStatusCode: http.StatusBadRequest,
+			Message:        msg,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	err = a.Manager.Heartbeat(name, &s)
+	if errors.Is(err, ErrUnknownNode) {
+		log.Printf("Heartbeat from unknown node %v\n", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) GetNodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(a.Manager.GetNodes())
+}
+
+func (a *Api) GetNodeHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	n, err := a.Manager.GetNode(name)
+	if err != nil {
+		log.Printf("No node with name %v found", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(n)
 }
@@ -0,0 +1,211 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/task"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+const DefaultMaxRestarts = 3
+
+func (m *Manager) DoHealthChecks(ctx context.Context) {
+	loop.Run(ctx, 5*time.Second, nil, func() {
+		log.Println("Performing task health checks")
+		m.doHealthChecks()
+		log.Println("Task health checks completed")
+	})
+}
+
+func (m *Manager) doHealthChecks() {
+	now := time.Now()
+	for _, t := range m.GetTasks() {
+		if t.State != task.Running || t.HealthCheck == nil {
+			continue
+		}
+		if now.Sub(m.lastHealthCheck[t.ID]) < t.HealthCheck.GetInterval() {
+			continue
+		}
+		m.lastHealthCheck[t.ID] = now
+
+		checkErr := m.checkTaskHealth(*t)
+		restart := false
+		err := m.updateTask(t.ID, func(dbTask *task.Task) bool {
+			// The task may have been stopped or restarted while it was
+			// being checked, in which case the result no longer applies.
+			if dbTask.State != task.Running || dbTask.RestartCount != t.RestartCount {
+				return false
+			}
+			if checkErr == nil {
+				if dbTask.HealthFailures == 0 {
+					return false
+				}
+				dbTask.HealthFailures = 0
+				return true
+			}
+
+			dbTask.HealthFailures++
+			log.Printf("Health check %d/%d for task %v failed: %v\n",
+				dbTask.HealthFailures, t.HealthCheck.GetFailureThreshold(), t.ID, checkErr)
+			if dbTask.HealthFailures >= t.HealthCheck.GetFailureThreshold() {
+				if dbTask.RestartCount < m.MaxRestarts {
+					restart = true
+				} else {
+					log.Printf("Task %v reached the limit of %d restarts\n", t.ID, m.MaxRestarts)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("Error updating health of task %v: %v\n", t.ID, err)
+			continue
+		}
+		if restart {
+			m.restartTask(t.ID, t.RestartCount)
+		}
+	}
+}
+
+func (m *Manager) checkTaskHealth(t task.Task) error {
+	w, ok := m.TaskWorker(t.ID)
+	if !ok {
+		return fmt.Errorf("no worker known for task %v", t.ID)
+	}
+	hc := t.HealthCheck
+	client := http.Client{Timeout: hc.GetTimeout()}
+
+	if hc.Type == task.ExecHealthCheck {
+		url := fmt.Sprintf("http://%s/tasks/%s/health", w, t.ID)
+		resp, err := client.Get(url)
+		if err != nil {
+			return fmt.Errorf("connecting to worker %v: %w", w, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("exec check responded with status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(w)
+	if err != nil {
+		return err
+	}
+	port, err := hostPort(t, hc.Port)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(host, port)
+
+	switch hc.Type {
+	case task.TCPHealthCheck:
+		conn, err := net.DialTimeout("tcp", addr, hc.GetTimeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case task.HTTPHealthCheck, "":
+		resp, err := client.Get(fmt.Sprintf("http://%s%s", addr, hc.Path))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("responded with status %d", resp.StatusCode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown health check type %q", hc.Type)
+	}
+}
+
+// hostPort finds the host port the worker published containerPort on, or
+// any published port when containerPort is empty.
+func hostPort(t task.Task, containerPort string) (string, error) {
+	if containerPort != "" {
+		bindings := t.HostPorts[nat.Port(containerPort)]
+		if len(bindings) == 0 {
+			return "", fmt.Errorf("port %s of task %v is not published", containerPort, t.ID)
+		}
+		return bindings[0].HostPort, nil
+	}
+	for _, bindings := range t.HostPorts {
+		if len(bindings) > 0 {
+			return bindings[0].HostPort, nil
+		}
+	}
+	return "", fmt.Errorf("task %v has no published ports", t.ID)
+}
+
+// restartTask asks the task's worker to replace its container, unless the
+// task has been restarted since restartCount was read. The task is only
+// marked as restarted once the worker accepted that, so that a failed
+// attempt is retried after the next failed health check.
+func (m *Manager) restartTask(taskID uuid.UUID, restartCount int) {
+	t, err := m.taskDb.Get(taskID.String())
+	if err != nil {
+		log.Printf("Error getting task %v: %v\n", taskID, err)
+		return
+	}
+	if t.State != task.Running || t.RestartCount != restartCount {
+		return
+	}
+	t.State = task.Scheduled
+	t.RestartCount++
+	t.HealthFailures = 0
+	w, ok := m.TaskWorker(t.ID)
+	if !ok {
+		log.Printf("No worker known to restart task %v on\n", t.ID)
+		return
+	}
+
+	te := task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Running,
+		Timestamp: time.Now(),
+		Task:      *t,
+	}
+	data, err := json.Marshal(te)
+	if err != nil {
+		log.Printf("Unable to marshal task object: %v.\n", t)
+		return
+	}
+
+	url := fmt.Sprintf("http://%s/tasks", w)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		log.Printf("Error connecting to %v: %v\n", w, err)
+		m.metrics.workerError(w, "restart_task")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		log.Printf("Error restarting task %v on %v: status %d\n", t.ID, w, resp.StatusCode)
+		m.metrics.workerError(w, "restart_task")
+		return
+	}
+
+	err = m.updateTask(t.ID, func(dbTask *task.Task) bool {
+		if dbTask.State != task.Running || dbTask.RestartCount != restartCount {
+			return false
+		}
+		dbTask.State = task.Scheduled
+		dbTask.RestartCount++
+		dbTask.HealthFailures = 0
+		return true
+	})
+	if err != nil {
+		log.Printf("Error saving restart of task %v: %v\n", t.ID, err)
+		return
+	}
+	log.Printf("Restarted task %v on %v (restart %d)\n", t.ID, w, t.RestartCount)
+}
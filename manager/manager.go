@@ -2,64 +2,146 @@ package manager
 
 import (
 	"bytes"
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/node"
+	"dumch/cube/queue"
+	"dumch/cube/scheduler"
+	"dumch/cube/store"
 	"dumch/cube/task"
 	"dumch/cube/worker"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/golang-collections/collections/queue"
 	"github.com/google/uuid"
 )
 
+const (
+	DefaultProcessPeriod = 10 * time.Second
+	DefaultUpdatePeriod  = 15 * time.Second
+)
+
 type Manager struct {
-	Pending       queue.Queue
-	TaskDb        map[uuid.UUID]*task.Task
-	EventDb       map[uuid.UUID]*task.TaskEvent
-	Workers       []string
-	WorkerTaskMap map[string][]uuid.UUID
-	TaskWorkerMap map[uuid.UUID]string
-	LastWorker    int
+	Pending   queue.Queue[task.TaskEvent]
+	taskDb    store.Store[*task.Task]
+	EventDb   store.Store[*task.TaskEvent]
+	Scheduler scheduler.Scheduler
+	// mu guards the set of workers, which changes as nodes register, and
+	// where tasks are placed
+	mu          sync.RWMutex
+	workers     []string
+	workerNodes []*node.Node
+	workerTasks map[string][]uuid.UUID
+	taskWorkers map[uuid.UUID]string
+	// taskMu serializes changes to stored tasks, so that the loops
+	// updating them do not overwrite each other's changes
+	taskMu sync.Mutex
+	// MaxRestarts limits how often an unhealthy or failed task is restarted
+	MaxRestarts int
+	// RestartBackoff is how long to wait before restarting a failed task.
+	// It doubles with every restart, up to MaxRestartBackoff.
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+	// NodeTimeout is how long a registered node may miss heartbeats before
+	// it is not ready, and NodeRemoveAfter before it is removed.
+	NodeTimeout     time.Duration
+	NodeRemoveAfter time.Duration
+	// ProcessPeriod is the longest pending events wait when the manager
+	// missed their arrival, and UpdatePeriod how often workers are polled.
+	ProcessPeriod time.Duration
+	UpdatePeriod  time.Duration
+	// pending signals ProcessTasks that an event was queued
+	pending         loop.Signal
+	lastHealthCheck map[uuid.UUID]time.Time
+	metrics         *metrics
 }
 
-func New(workers []string) *Manager {
+// New creates a manager for the given worker addresses ("host:port").
+// schedulerType is one of the scheduler package types, e.g. "roundrobin",
+// and dbType one of the store package types, e.g. "persistent".
+func New(workers []string, schedulerType string, dbType string) (*Manager, error) {
+	s, err := scheduler.New(schedulerType)
+	if err != nil {
+		return nil, err
+	}
+
+	taskDb, err := store.New[*task.Task](dbType, "manager_tasks.db", "tasks")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create task store: %w", err)
+	}
+	eventDb, err := store.New[*task.TaskEvent](dbType, "manager_events.db", "events")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create event store: %w", err)
+	}
+
 	workerTaskMap := make(map[string][]uuid.UUID)
+	var nodes []*node.Node
 	for _, w := range workers {
 		workerTaskMap[w] = []uuid.UUID{}
+		nodes = append(nodes, node.NewNode(w, fmt.Sprintf("http://%s", w), "worker"))
 	}
-	return &Manager{
-		Pending:       *queue.New(),
-		TaskDb:        make(map[uuid.UUID]*task.Task),
-		EventDb:       make(map[uuid.UUID]*task.TaskEvent),
-		Workers:       workers,
-		WorkerTaskMap: workerTaskMap,
-		TaskWorkerMap: make(map[uuid.UUID]string),
+	m := Manager{
+		taskDb:            taskDb,
+		EventDb:           eventDb,
+		workers:           workers,
+		workerNodes:       nodes,
+		workerTasks:       workerTaskMap,
+		taskWorkers:       make(map[uuid.UUID]string),
+		Scheduler:         s,
+		MaxRestarts:       DefaultMaxRestarts,
+		RestartBackoff:    DefaultRestartBackoff,
+		MaxRestartBackoff: DefaultMaxRestartBackoff,
+		NodeTimeout:       DefaultNodeTimeout,
+		NodeRemoveAfter:   DefaultNodeRemoveAfter,
+		ProcessPeriod:     DefaultProcessPeriod,
+		UpdatePeriod:      DefaultUpdatePeriod,
+		pending:           loop.NewSignal(),
+		lastHealthCheck:   make(map[uuid.UUID]time.Time),
 	}
+	m.metrics = newMetrics(&m)
+	return &m, nil
 }
 
-func (m *Manager) SelectWorker() string {
-	if m.LastWorker+1 < len(m.Workers) {
-		m.LastWorker++
-	} else {
-		m.LastWorker = 0
+func (m *Manager) SelectWorker(t task.Task) (*node.Node, error) {
+	m.updateNodeAllocations()
+	ready := m.readyNodes()
+	nodes := m.withFreePorts(t, ready)
+	if len(nodes) == 0 && len(ready) > 0 {
+		return nil, fmt.Errorf("%w on every node: %v", ErrPortConflict, t.RequestedHostPorts())
+	}
+	candidates := m.Scheduler.SelectCandidateNodes(t, nodes)
+	if len(candidates) == 0 {
+		return nil, errors.New("no available candidates match resource request for task")
+	}
+	scores := m.Scheduler.Score(t, candidates)
+	selected := m.Scheduler.Pick(scores, candidates)
+	if selected == nil {
+		return nil, errors.New("scheduler did not pick a node for task")
 	}
-	return m.Workers[m.LastWorker]
+	return selected, nil
 }
 
 func (m *Manager) updateTasks() {
-	for _, worker := range m.Workers {
+	for _, worker := range m.Workers() {
 		log.Printf("Checking worker %v for task updates\n", worker)
 		url := fmt.Sprintf("http://%s/tasks", worker)
 		log.Printf("About to get tasks from worker with url %s", url)
 		resp, err := http.Get(url)
 		if err != nil {
 			log.Printf("Error connecting to %v: %v\n", worker, err)
+			m.metrics.workerError(worker, "update_tasks")
+			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			log.Printf("Error sending request: %v\n", err)
+			log.Printf("Unexpected status from %v: %d\n", worker, resp.StatusCode)
+			m.metrics.workerError(worker, "update_tasks")
+			continue
 		}
 
 		d := json.NewDecoder(resp.Body)
@@ -72,101 +154,356 @@ func (m *Manager) updateTasks() {
 		for _, t := range tasks {
 			log.Printf("Attempting to update task %v\n", t.ID)
 
-			dbTask, ok := m.TaskDb[t.ID]
-			if !ok {
-				log.Printf("Task with ID %s not found\n", t.ID)
-				return
-			}
-			if dbTask.State != t.State {
+			err := m.updateTask(t.ID, func(dbTask *task.Task) bool {
+				// Ignore what is left of a task from before it was
+				// restarted, possibly on another worker.
+				if t.RestartCount < dbTask.RestartCount {
+					return false
+				}
+				if owner, ok := m.TaskWorker(t.ID); ok && owner != worker {
+					return false
+				}
 				dbTask.State = t.State
+				dbTask.StartTime = t.StartTime
+				dbTask.FinishTime = t.FinishTime
+				dbTask.ContainerID = t.ContainerID
+				dbTask.HostPorts = t.HostPorts
+				dbTask.Reason = t.Reason
+				dbTask.Events = t.Events
+				return true
+			})
+			if err != nil {
+				log.Printf("Error updating task %s: %v\n", t.ID, err)
+				continue
 			}
 
-			dbTask.StartTime = t.StartTime
-			dbTask.FinishTime = t.FinishTime
-			dbTask.ContainerID = t.ContainerID
+			// After a restart the manager only knows its tasks from the
+			// store, so relearn where they run from the worker reporting them.
+			if _, ok := m.TaskWorker(t.ID); !ok {
+				m.assignTask(worker, t.ID)
+			}
 		}
 	}
 }
 
-func (m *Manager) UpdateTasks() {
-	for {
+// UpdateTasks polls the workers for task updates every UpdatePeriod and
+// restarts failed tasks, until ctx is done.
+func (m *Manager) UpdateTasks(ctx context.Context) {
+	loop.Run(ctx, m.UpdatePeriod, nil, func() {
 		log.Println("Checking for task updates from workers")
 		m.updateTasks()
+		m.restartFailedTasks()
 		log.Println("Task updates completed")
-		log.Println("Sleeping for 15 seconds")
-		time.Sleep(15 * time.Second)
-	}
+	})
 }
 
-func (m *Manager) ProcessTasks() {
-	for {
-		log.Println("Processing any tasks in the queue")
-		m.SendWork()
-		log.Println("Sleeping for 10 seconds")
-		time.Sleep(10 * time.Second)
+func (m *Manager) updateNodeStats() {
+	for _, n := range m.readyNodes() {
+		log.Printf("Collecting stats for node %v\n", n.Name)
+		s, err := n.GetStats()
+		if err != nil {
+			log.Printf("Error updating stats for node %v: %v\n", n.Name, err)
+			continue
+		}
+		m.setNodeStats(n.Name, s)
 	}
 }
 
-func (m *Manager) SendWork() {
-	if m.Pending.Len() > 0 {
-		w := m.SelectWorker()
-		e := m.Pending.Dequeue()
-		te := e.(task.TaskEvent)
-		t := te.Task
-		log.Printf("Pulled %v off pending queue\n", t)
+func (m *Manager) UpdateNodeStats(ctx context.Context) {
+	loop.Run(ctx, 15*time.Second, nil, m.updateNodeStats)
+}
 
-		m.EventDb[te.ID] = &te
-		m.WorkerTaskMap[w] = append(m.WorkerTaskMap[w], te.Task.ID)
-		m.TaskWorkerMap[t.ID] = w
+// ProcessTasks sends pending events to workers as soon as they are added,
+// and at the latest every ProcessPeriod, until ctx is done.
+func (m *Manager) ProcessTasks(ctx context.Context) {
+	loop.Run(ctx, m.ProcessPeriod, m.pending, func() {
+		log.Println("Processing any tasks in the queue")
+		// Events that cannot be scheduled yet are queued again, so only
+		// process the ones that were pending to begin with.
+		for n := m.Pending.Len(); n > 0; n-- {
+			m.SendWork()
+		}
+	})
+}
 
-		t.State = task.Scheduled
-		m.TaskDb[t.ID] = &t
+func (m *Manager) SendWork() {
+	te, ok := m.Pending.Dequeue()
+	if !ok {
+		log.Println("No work in the queue")
+		return
+	}
 
-		data, err := json.Marshal(te)
-		if err != nil {
-			log.Printf("Unable to marshal task object: %v.\n", t)
-		}
+	err := m.EventDb.Put(te.ID.String(), &te)
+	if err != nil {
+		log.Printf("Error attempting to store task event %s: %v\n", te.ID, err)
+		return
+	}
+	log.Printf("Pulled %v off pending queue\n", te)
 
-		url := fmt.Sprintf("http://%s/tasks", w)
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if taskWorker, ok := m.TaskWorker(te.Task.ID); ok {
+		persistedTask, err := m.taskDb.Get(te.Task.ID.String())
 		if err != nil {
-			log.Printf("Error connecting to %v: %v\n", w, err)
-			m.Pending.Enqueue(te)
+			log.Printf("Unable to schedule task %s: %v\n", te.Task.ID, err)
 			return
 		}
-
-		d := json.NewDecoder(resp.Body)
-		if resp.StatusCode != http.StatusCreated {
-			e := worker.ErrResponse{}
-			err := d.Decode(&e)
-			if err != nil {
-				fmt.Printf("Error decoding response: %s\n", err.Error())
-				return
-			}
-			log.Printf("Response error (%d): %s\n", e.HTTPStatusCode, e.Message)
+		if te.State == task.Completed && task.ValidStateTransition(persistedTask.State, te.State) {
+			m.stopTask(taskWorker, te.Task.ID.String())
 			return
 		}
+		log.Printf("Invalid request: existing task %s is in state %v and cannot transition to %v\n",
+			persistedTask.ID, persistedTask.State, te.State)
+		return
+	}
+	if te.State == task.Completed {
+		m.stopUnplacedTask(te.Task.ID)
+		return
+	}
+	if stored, err := m.taskDb.Get(te.Task.ID.String()); err == nil && stored.State == task.Completed {
+		// E.g. a restart queued before the task was stopped
+		log.Printf("Dropping event %v of stopped task %v\n", te.ID, te.Task.ID)
+		return
+	}
 
-		t = task.Task{}
-		err = d.Decode(&t)
+	t := te.Task
+	n, err := m.SelectWorker(t)
+	if errors.Is(err, ErrPortConflict) {
+		log.Printf("Rejecting task %s: %v\n", t.ID, err)
+		t.State = task.Failed
+		t.FinishTime = time.Now().UTC()
+		t.Reason = err.Error()
+		m.saveTask(&t)
+		return
+	}
+	if err != nil {
+		log.Printf("Error selecting worker for task %s: %v\n", t.ID, err)
+		m.Pending.Enqueue(te)
+		return
+	}
+	w := n.Name
+
+	m.assignTask(w, t.ID)
+
+	t.State = task.Scheduled
+	m.saveTask(&t)
+	te.Task = t
+
+	data, err := json.Marshal(te)
+	if err != nil {
+		log.Printf("Unable to marshal task object: %v.\n", t)
+	}
+
+	url := fmt.Sprintf("%s/tasks", n.Api)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err == nil && resp.StatusCode == http.StatusCreated {
+		m.metrics.observeScheduled(te)
+	}
+	if err != nil {
+		log.Printf("Error connecting to %v: %v\n", w, err)
+		m.metrics.workerError(w, "send_work")
+		m.unassignTask(w, t.ID)
+		m.Pending.Enqueue(te)
+		return
+	}
+
+	d := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		m.metrics.workerError(w, "send_work")
+		e := worker.ErrResponse{}
+		err := d.Decode(&e)
 		if err != nil {
 			fmt.Printf("Error decoding response: %s\n", err.Error())
 			return
 		}
-		log.Printf("Decoded task: %#v\n", t)
-	} else {
-		log.Println("No work in the queue")
+		log.Printf("Response error (%d): %s\n", e.HTTPStatusCode, e.Message)
+		return
+	}
+
+	t = task.Task{}
+	err = d.Decode(&t)
+	if err != nil {
+		fmt.Printf("Error decoding response: %s\n", err.Error())
+		return
 	}
+	log.Printf("Decoded task: %#v\n", t)
+}
+
+// StopTask queues an event stopping the task.
+func (m *Manager) StopTask(taskID uuid.UUID) error {
+	t, err := m.taskDb.Get(taskID.String())
+	if err != nil {
+		return err
+	}
+	te := task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Completed,
+		Timestamp: time.Now(),
+		Task:      *t,
+	}
+	te.Task.State = task.Completed
+	m.AddTask(te)
+	log.Printf("Added task event %v to stop task %v\n", te.ID, t.ID)
+	return nil
+}
+
+// stopUnplacedTask marks a task that no worker runs as completed, e.g. one
+// waiting to be restarted or rejected for a port conflict, so that events
+// queued for it no longer place it on a worker.
+func (m *Manager) stopUnplacedTask(taskID uuid.UUID) {
+	err := m.updateTask(taskID, func(t *task.Task) bool {
+		if t.State == task.Completed {
+			return false
+		}
+		log.Printf("Stopping task %v, which is not placed on a worker\n", t.ID)
+		t.State = task.Completed
+		t.FinishTime = time.Now().UTC()
+		return true
+	})
+	if err != nil {
+		log.Printf("Error stopping task %v: %v\n", taskID, err)
+	}
+}
+
+func (m *Manager) TaskWorker(taskID uuid.UUID) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	w, ok := m.taskWorkers[taskID]
+	return w, ok
+}
+
+func (m *Manager) assignTask(worker string, taskID uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workerTasks[worker] = append(m.workerTasks[worker], taskID)
+	m.taskWorkers[taskID] = worker
+}
+
+// unassignTask forgets that the task was placed on the worker so that it
+// can be scheduled again.
+func (m *Manager) unassignTask(worker string, taskID uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.taskWorkers, taskID)
+	ids := m.workerTasks[worker]
+	for i, id := range ids {
+		if id == taskID {
+			m.workerTasks[worker] = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Manager) stopTask(worker string, taskID string) {
+	client := &http.Client{}
+	url := fmt.Sprintf("http://%s/tasks/%s", worker, taskID)
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		log.Printf("Error creating request to delete task %s: %v\n", taskID, err)
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error connecting to worker at %s: %v\n", url, err)
+		m.metrics.workerError(worker, "stop_task")
+		return
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		m.metrics.workerError(worker, "stop_task")
+		log.Printf("Unexpected status stopping task %s: %d\n", taskID, resp.StatusCode)
+		return
+	}
+
+	log.Printf("Task %s has been scheduled to be stopped", taskID)
+}
+
+func (m *Manager) saveTask(t *task.Task) {
+	m.taskMu.Lock()
+	defer m.taskMu.Unlock()
+	err := m.taskDb.Put(t.ID.String(), t)
+	if err != nil {
+		log.Printf("Error saving task %v: %v\n", t.ID, err)
+	}
+}
+
+// updateTask applies update to the stored task and saves it, unless
+// update returns false. No other change to the task happens in between.
+func (m *Manager) updateTask(taskID uuid.UUID, update func(t *task.Task) bool) error {
+	m.taskMu.Lock()
+	defer m.taskMu.Unlock()
+	t, err := m.taskDb.Get(taskID.String())
+	if err != nil {
+		return err
+	}
+	if !update(t) {
+		return nil
+	}
+	return m.taskDb.Put(t.ID.String(), t)
 }
 
 func (m *Manager) AddTask(te task.TaskEvent) {
+	if te.Timestamp.IsZero() {
+		te.Timestamp = time.Now()
+	}
 	m.Pending.Enqueue(te)
+	m.pending.Notify()
 }
 
 func (m *Manager) GetTasks() []*task.Task {
-	var tasks []*task.Task
-	for _, v := range m.TaskDb {
-		tasks = append(tasks, v)
+	tasks, err := m.taskDb.List()
+	if err != nil {
+		log.Printf("Error getting list of tasks: %v\n", err)
+		return nil
 	}
 	return tasks
 }
+
+// TaskDetails is a task along with the resource usage of its container,
+// which is only known while the task is running.
+type TaskDetails struct {
+	*task.Task
+	Stats *task.ContainerStats
+}
+
+// GetTask returns a task and, if it is running, the resource usage its
+// worker last sampled.
+func (m *Manager) GetTask(taskID uuid.UUID) (*TaskDetails, error) {
+	t, err := m.taskDb.Get(taskID.String())
+	if err != nil {
+		return nil, err
+	}
+	details := TaskDetails{Task: t}
+	if t.State != task.Running {
+		return &details, nil
+	}
+	w, ok := m.TaskWorker(t.ID)
+	if !ok {
+		return &details, nil
+	}
+
+	s, err := m.getTaskStats(w, t.ID)
+	if err != nil {
+		log.Printf("Error getting stats of task %v from %v: %v\n", t.ID, w, err)
+	}
+	details.Stats = s
+	return &details, nil
+}
+
+func (m *Manager) getTaskStats(worker string, taskID uuid.UUID) (*task.ContainerStats, error) {
+	url := fmt.Sprintf("http://%s/tasks/%s/stats", worker, taskID)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	s := task.ContainerStats{}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -1,35 +1,35 @@
 package manager
 
 import (
+	"bytes"
+	"context"
+	"dumch/cube/node"
+	"dumch/cube/stats"
 	"dumch/cube/task"
 	"dumch/cube/worker"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/golang-collections/collections/queue"
+	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
 )
 
 func TestManager(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url)
 
-	host := "localhost" // os.Getenv("CUBE_HOST")
-	port := 5555        // os.Getenv("CUBE_PORT")
-	fmt.Println("Starting Cube worker")
-
-	w := worker.Worker{
-		Queue: *queue.New(),
-		Db:    make(map[uuid.UUID]*task.Task),
-	}
-	api := worker.Api{Address: host, Port: port, Worker: &w}
-
-	go w.RunTasks()
-	go w.CollectStats()
-	go api.Start()
-
-	workers := []string{fmt.Sprintf("%s:%d", host, port)}
-	m := New(workers)
-
+	var ids []uuid.UUID
 	for i := 0; i < 3; i++ {
 		t := task.Task{
 			ID:    uuid.New(),
@@ -44,14 +44,815 @@ func TestManager(test *testing.T) {
 		}
 		m.AddTask(te)
 		m.SendWork()
+		ids = append(ids, t.ID)
+	}
+
+	runQueued(test, w)
+	m.updateTasks()
+
+	for _, t := range m.GetTasks() {
+		fmt.Printf("[Manager] Task: id: %s, state: %d\n", t.ID, t.State)
+		if t.State != task.Running || t.ContainerID == "" {
+			test.Fatalf("Expected task %s to be running, got %v", t.ID, t)
+		}
+	}
+
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/tasks/"+ids[0].String(), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		test.Fatalf("Error stopping task: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		test.Fatalf("Expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	m.SendWork()
+	runQueued(test, w)
+	m.updateTasks()
+
+	stopped, _ := m.taskDb.Get(ids[0].String())
+	if stopped.State != task.Completed {
+		test.Fatalf("Expected task to be completed, got state %v", stopped.State)
+	}
+	if _, ok := w.Runtime.(*task.FakeRuntime).Container(stopped.ContainerID); ok {
+		test.Fatalf("Expected container %s to be removed", stopped.ContainerID)
+	}
+}
+
+func TestStartInvalidTask(test *testing.T) {
+	m := newManager(test)
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := task.Task{ID: uuid.New(), Name: "test-container", State: task.Scheduled, Image: "strm/helloworld-http",
+		Env: []string{"PORT"}, WorkingDir: "app"}
+	data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		test.Fatalf("Error posting task: %v", err)
 	}
+	e := ErrResponse{}
+	json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(e.Message, "PORT") || !strings.Contains(e.Message, "app") {
+		test.Fatalf("Expected both errors with status %d, got %d: %v", http.StatusBadRequest, resp.StatusCode, e.Message)
+	}
+	if m.Pending.Len() != 0 {
+		test.Fatalf("Expected invalid task not to be queued")
+	}
+
+	for _, hc := range []task.HealthCheck{
+		{Type: "grpc"},
+		{Type: task.ExecHealthCheck},
+		{Type: task.HTTPHealthCheck, Path: "health"},
+		{Type: task.TCPHealthCheck, Port: "80/icmp"},
+	} {
+		t := task.Task{ID: uuid.New(), Name: "test-container", Image: "strm/helloworld-http", HealthCheck: &hc}
+		data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+		resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			test.Fatalf("Error posting task: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			test.Fatalf("Expected health check %+v to be rejected, got status %d", hc, resp.StatusCode)
+		}
+	}
+}
 
-	go m.UpdateTasks()
+func TestPortConflicts(test *testing.T) {
+	w1, url1 := newWorker(test)
+	w2, url2 := newWorker(test)
+	m := newManager(test, url1, url2)
 
+	workers := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		t := task.Task{ID: uuid.New(), Name: fmt.Sprintf("test-container-%d", i), State: task.Scheduled,
+			Image: "strm/helloworld-http", PortBindings: map[string]string{"80/tcp": "8080"}}
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+		m.SendWork()
+		if w, ok := m.TaskWorker(t.ID); ok {
+			workers[w] = true
+		} else if persisted, _ := m.taskDb.Get(t.ID.String()); persisted.State != task.Failed {
+			test.Fatalf("Expected the third task to be rejected, got %v", persisted.State)
+		}
+	}
+	if len(workers) != 2 || m.Pending.Len() != 0 {
+		test.Fatalf("Expected tasks on both workers and none pending, got %v and %d", workers, m.Pending.Len())
+	}
+
+	runQueued(test, w1)
+	runQueued(test, w2)
+	m.updateTasks()
+	running := 0
+	for _, t := range m.GetTasks() {
+		if t.State != task.Running {
+			continue
+		}
+		running++
+		if t.HostPorts["80/tcp"][0].HostPort != "8080" {
+			test.Fatalf("Expected task %v to report its bound port, got %v", t.ID, t.HostPorts)
+		}
+	}
+	if running != 2 {
+		test.Fatalf("Expected 2 running tasks, got %d", running)
+	}
+}
+
+func TestAdmission(test *testing.T) {
+	_, url := newWorker(test)
+	m := newManager(test, url)
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+	m.workerNodes[0].UpdateStats(&stats.Stats{
+		CpuCount:  4,
+		MemStats:  &mem.VirtualMemoryStat{Total: 4 << 30},
+		DiskStats: &disk.UsageStat{Total: 100 << 30},
+	})
+
+	for _, tc := range []struct {
+		cpu    float64
+		memory int64
+		disk   int64
+		status int
+	}{
+		{4, 4 << 30, 100 << 30, http.StatusOK},
+		{4.5, 0, 0, http.StatusUnprocessableEntity},
+		{0, 8 << 30, 0, http.StatusUnprocessableEntity},
+		{0, 0, 200 << 30, http.StatusUnprocessableEntity},
+		{-1, 0, 0, http.StatusBadRequest},
+		{0, 1 << 20, 0, http.StatusBadRequest},
+	} {
+		t := task.Task{ID: uuid.New(), Name: "test-container", State: task.Scheduled, Image: "strm/helloworld-http",
+			Cpu: tc.cpu, Memory: tc.memory, Disk: tc.disk}
+		data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+		resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			test.Fatalf("Error posting task: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			test.Fatalf("Expected status %d for %+v, got %d", tc.status, tc, resp.StatusCode)
+		}
+	}
+	if m.Pending.Len() != 1 {
+		test.Fatalf("Expected only the admitted task to be queued, got %d", m.Pending.Len())
+	}
+}
+
+func TestManagerRecoversTaskWorkers(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url)
+
+	t := task.Task{ID: uuid.New(), Name: "test-container", Image: "strm/helloworld-http"}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	m.SendWork()
+	runQueued(test, w)
+
+	// A manager restarted on the same store forgets where tasks run.
+	restarted := newManager(test, url)
+	restarted.taskDb = m.taskDb
+	restarted.updateTasks()
+
+	if w, _ := restarted.TaskWorker(t.ID); w != url {
+		test.Fatalf("Expected task to be mapped to %s, got %q", url, w)
+	}
+}
+
+func TestHealthCheckRestartsTask(test *testing.T) {
+	w, url := newWorker(test)
+	rt := w.Runtime.(*task.FakeRuntime)
+	m := newManager(test, url)
+	m.MaxRestarts = 1
+
+	t := task.Task{
+		ID:    uuid.New(),
+		Name:  "test-container",
+		Image: "strm/helloworld-http",
+		HealthCheck: &task.HealthCheck{
+			Type:             task.ExecHealthCheck,
+			Command:          []string{"true"},
+			Interval:         time.Nanosecond,
+			FailureThreshold: 2,
+		},
+	}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	m.SendWork()
+	runQueued(test, w)
+	m.updateTasks()
+
+	m.doHealthChecks()
+	healthy, _ := m.taskDb.Get(t.ID.String())
+	if healthy.HealthFailures != 0 {
+		test.Fatalf("Expected no health check failures, got %d", healthy.HealthFailures)
+	}
+	firstContainer := healthy.ContainerID
+
+	rt.ExecHandler = func(string, []string) task.ExecResult {
+		return task.ExecResult{ExitCode: 1}
+	}
+	m.doHealthChecks()
+	m.doHealthChecks()
+	runQueued(test, w)
+	m.updateTasks()
+
+	restarted, _ := m.taskDb.Get(t.ID.String())
+	if restarted.RestartCount != 1 || restarted.State != task.Running {
+		test.Fatalf("Expected task to be running after one restart, got %v", restarted)
+	}
+	if restarted.ContainerID == firstContainer {
+		test.Fatalf("Expected a new container, still on %s", firstContainer)
+	}
+	if _, ok := rt.Container(firstContainer); ok {
+		test.Fatalf("Expected container %s to be removed", firstContainer)
+	}
+
+	m.doHealthChecks()
+	m.doHealthChecks()
+	if w.Queue.Len() != 0 {
+		test.Fatalf("Expected no restart beyond the limit")
+	}
+}
+
+func TestHealthCheckRestartNeedsWorker(test *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	m := newManager(test)
+
+	t := task.Task{
+		ID:    uuid.New(),
+		State: task.Running,
+		HealthCheck: &task.HealthCheck{
+			Type:             task.ExecHealthCheck,
+			Command:          []string{"true"},
+			Interval:         time.Nanosecond,
+			FailureThreshold: 1,
+		},
+	}
+	m.taskDb.Put(t.ID.String(), &t)
+	m.assignTask(strings.TrimPrefix(server.URL, "http://"), t.ID)
+
+	m.doHealthChecks()
+	unhealthy, _ := m.taskDb.Get(t.ID.String())
+	if unhealthy.State != task.Running || unhealthy.RestartCount != 0 || unhealthy.HealthFailures != 1 {
+		test.Fatalf("Expected task to stay running until the worker restarts it, got %v", unhealthy)
+	}
+
+	rec := httptest.NewRecorder()
+	m.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `call="restart_task"`) {
+		test.Fatalf("Expected the failed restart to be counted, got:\n%s", rec.Body)
+	}
+}
+
+func TestFailedTaskIsRescheduled(test *testing.T) {
+	w1, url1 := newWorker(test)
+	w2, url2 := newWorker(test)
+	m := newManager(test, url1, url2)
+	m.RestartBackoff = 0
+
+	t := task.Task{
+		ID:            uuid.New(),
+		Name:          "test-container",
+		Image:         "strm/helloworld-http",
+		RestartPolicy: "on-failure",
+	}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	m.SendWork()
+	runQueued(test, w2)
+	m.updateTasks()
+
+	failed, _ := m.taskDb.Get(t.ID.String())
+	w2.Runtime.(*task.FakeRuntime).Exit(failed.ContainerID, 1)
+	w2.InspectRunningTasks()
+	m.updateTasks()
+
+	failed, _ = m.taskDb.Get(t.ID.String())
+	if failed.State != task.Failed {
+		test.Fatalf("Expected task to have failed, got state %v", failed.State)
+	}
+
+	m.restartFailedTasks()
+	m.SendWork()
+	runQueued(test, w1)
+	m.updateTasks()
+
+	restarted, _ := m.taskDb.Get(t.ID.String())
+	if restarted.State != task.Running || restarted.RestartCount != 1 {
+		test.Fatalf("Expected task to be running after one restart, got %v", restarted)
+	}
+	if w, _ := m.TaskWorker(t.ID); w != url1 {
+		test.Fatalf("Expected task to move to %s, got %s", url1, w)
+	}
+}
+
+func TestStopTaskWaitingForRestart(test *testing.T) {
+	m := newManager(test)
+	m.RestartBackoff = 0
+
+	t := task.Task{ID: uuid.New(), State: task.Failed, RestartPolicy: "always"}
+	m.taskDb.Put(t.ID.String(), &t)
+	m.restartFailedTasks()
+	// Without workers, the restart goes back to the queue.
+	m.SendWork()
+
+	if err := m.StopTask(t.ID); err != nil {
+		test.Fatalf("Error stopping task: %v", err)
+	}
+	for m.Pending.Len() > 0 {
+		m.SendWork()
+	}
+
+	stopped, _ := m.taskDb.Get(t.ID.String())
+	if stopped.State != task.Completed {
+		test.Fatalf("Expected the task to be stopped, got %v", stopped.State)
+	}
+	if _, ok := m.TaskWorker(t.ID); ok {
+		test.Fatalf("Expected the stopped task not to be placed on a worker")
+	}
+}
+
+func TestRestartPolicyAndBackoff(test *testing.T) {
+	m := newManager(test)
+	m.RestartBackoff = time.Minute
+
+	never := task.Task{ID: uuid.New(), State: task.Failed, FinishTime: time.Now().UTC()}
+	later := task.Task{ID: uuid.New(), State: task.Failed, RestartPolicy: "always",
+		FinishTime: time.Now().UTC().Add(-90 * time.Second), RestartCount: 1}
+	now := task.Task{ID: uuid.New(), State: task.Failed, RestartPolicy: "always",
+		FinishTime: time.Now().UTC().Add(-90 * time.Second)}
+	for _, t := range []task.Task{never, later, now} {
+		m.taskDb.Put(t.ID.String(), &t)
+	}
+
+	m.restartFailedTasks()
+
+	if m.Pending.Len() != 1 {
+		test.Fatalf("Expected exactly one task to be rescheduled, got %d", m.Pending.Len())
+	}
+	te, _ := m.Pending.Dequeue()
+	if te.Task.ID != now.ID || te.Task.RestartCount != 1 {
+		test.Fatalf("Expected task %v to be rescheduled, got %v", now.ID, te.Task)
+	}
+
+	if backoff := m.restartBackoff(10); backoff != m.MaxRestartBackoff {
+		test.Fatalf("Expected backoff to be capped at %v, got %v", m.MaxRestartBackoff, backoff)
+	}
+}
+
+func TestConcurrentRestarts(test *testing.T) {
+	m := newManager(test)
+	m.RestartBackoff = 0
+	m.MaxRestarts = 1
+
+	t := task.Task{ID: uuid.New(), State: task.Failed, RestartPolicy: "always"}
+	m.taskDb.Put(t.ID.String(), &t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.restartFailedTasks()
+		}()
+	}
+	wg.Wait()
+
+	if m.Pending.Len() != 1 {
+		test.Fatalf("Expected the task to be rescheduled once, got %d", m.Pending.Len())
+	}
+	restarted, _ := m.taskDb.Get(t.ID.String())
+	if restarted.RestartCount != 1 {
+		test.Fatalf("Expected one restart, got %d", restarted.RestartCount)
+	}
+}
+
+func TestHttpHealthCheck(test *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	m := newManager(test)
+	t := task.Task{
+		ID:          uuid.New(),
+		HealthCheck: &task.HealthCheck{Type: task.HTTPHealthCheck, Path: "/health", Port: "80/tcp"},
+		HostPorts:   nat.PortMap{"80/tcp": {{HostIP: "0.0.0.0", HostPort: port}}},
+	}
+	m.assignTask(net.JoinHostPort(host, "5555"), t.ID)
+
+	if err := m.checkTaskHealth(t); err != nil {
+		test.Fatalf("Expected task to be healthy, got %v", err)
+	}
+	status = http.StatusInternalServerError
+	if err := m.checkTaskHealth(t); err == nil {
+		test.Fatalf("Expected task to be unhealthy")
+	}
+}
+
+func TestNodeRegistration(test *testing.T) {
+	m := newManager(test)
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	body := `{"Name": "localhost:5555", "Role": "worker"}`
+	resp, err := http.Post(server.URL+"/nodes", "application/json", strings.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		test.Fatalf("Error registering node: %v, %v", err, resp)
+	}
+	if len(m.workers) != 1 || m.workerNodes[0].Api != "http://localhost:5555" {
+		test.Fatalf("Expected node to be registered, got %v", m.workerNodes)
+	}
+
+	body = `{"MemStats": {"total": 1024, "available": 512}, "DiskStats": {"total": 2048}}`
+	resp, err = http.Post(server.URL+"/nodes/localhost:5555/heartbeat", "application/json", strings.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		test.Fatalf("Error sending heartbeat: %v, %v", err, resp)
+	}
+	if n := m.workerNodes[0]; n.Memory != 1024 || n.Disk != 2048 {
+		test.Fatalf("Expected capacity from heartbeat, got %v", n)
+	}
+
+	resp, _ = http.Post(server.URL+"/nodes/unknown:1/heartbeat", "application/json", strings.NewReader("{}"))
+	if resp.StatusCode != http.StatusNotFound {
+		test.Fatalf("Expected unknown node to get %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestMissedHeartbeats(test *testing.T) {
+	m := newManager(test)
+	m.RegisterNode(&node.Node{Name: "localhost:5555"})
+
+	t := task.Task{ID: uuid.New(), State: task.Running}
+	m.taskDb.Put(t.ID.String(), &t)
+	m.assignTask("localhost:5555", t.ID)
+
+	m.workerNodes[0].LastHeartbeat = time.Now().UTC().Add(-time.Minute)
+	m.checkNodes()
+	if m.workerNodes[0].Status != node.NotReady {
+		test.Fatalf("Expected node to be not ready, got %v", m.workerNodes[0].Status)
+	}
+	if _, err := m.SelectWorker(task.Task{}); err == nil {
+		test.Fatalf("Expected no worker to be selected")
+	}
+
+	m.workerNodes[0].LastHeartbeat = time.Now().UTC().Add(-time.Hour)
+	m.checkNodes()
+	if len(m.workerNodes) != 0 || len(m.workers) != 0 {
+		test.Fatalf("Expected node to be removed, got %v", m.workerNodes)
+	}
+	failed, _ := m.taskDb.Get(t.ID.String())
+	if failed.State != task.Failed {
+		test.Fatalf("Expected task on removed node to fail, got state %v", failed.State)
+	}
+}
+
+func TestNodeAllocations(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url)
+	m.workerNodes[0].UpdateStats(&stats.Stats{
+		CpuCount:  4,
+		MemStats:  &mem.VirtualMemoryStat{Total: 4 << 30},
+		DiskStats: &disk.UsageStat{Total: 100 << 30},
+	})
+
+	for i := 0; i < 2; i++ {
+		t := task.Task{
+			ID:     uuid.New(),
+			Name:   fmt.Sprintf("test-container-%d", i),
+			Image:  "strm/helloworld-http",
+			Cpu:    0.5,
+			Memory: 256 << 20,
+			Disk:   1 << 30,
+		}
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+		m.SendWork()
+	}
+	runQueued(test, w)
+	m.updateTasks()
+
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/nodes/" + url)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		test.Fatalf("Error getting node: %v, %v", err, resp)
+	}
+	var n node.Node
+	json.NewDecoder(resp.Body).Decode(&n)
+	if n.Cores != 4 || n.CpuAllocated != 1 || n.MemoryAllocated != 512<<20 ||
+		n.DiskAllocated != 2<<30 || n.TaskCount != 2 {
+		test.Fatalf("Unexpected node capacity and allocation: %+v", n)
+	}
+
+	resp, _ = http.Get(server.URL + "/nodes/unknown:1")
+	if resp.StatusCode != http.StatusNotFound {
+		test.Fatalf("Expected %d for unknown node, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp, _ = http.Get(server.URL + "/nodes")
+	var nodes []node.Node
+	json.NewDecoder(resp.Body).Decode(&nodes)
+	if len(nodes) != 1 || nodes[0].Name != url {
+		test.Fatalf("Expected one node, got %v", nodes)
+	}
+}
+
+func TestGetTaskWithStats(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url)
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := task.Task{ID: uuid.New(), Name: "test-container", State: task.Scheduled, Image: "strm/helloworld-http"}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	m.SendWork()
+	runQueued(test, w)
+	m.updateTasks()
+
+	running, _ := m.taskDb.Get(t.ID.String())
+	w.Runtime.(*task.FakeRuntime).SetStats(running.ContainerID, task.ContainerStats{
+		CpuPercent:     25,
+		NetworkRxBytes: 1024,
+	})
+
+	resp, err := http.Get(server.URL + "/tasks/" + t.ID.String())
+	if err != nil {
+		test.Fatalf("Error getting task: %v", err)
+	}
+	details := TaskDetails{}
+	json.NewDecoder(resp.Body).Decode(&details)
+	if details.Task == nil || details.ID != t.ID || details.State != task.Running {
+		test.Fatalf("Unexpected task %v", details.Task)
+	}
+	if details.Stats == nil || details.Stats.CpuPercent != 25 || details.Stats.NetworkRxBytes != 1024 {
+		test.Fatalf("Unexpected task stats %v", details.Stats)
+	}
+
+	resp, _ = http.Get(server.URL + "/tasks/" + uuid.New().String())
+	if resp.StatusCode != http.StatusNotFound {
+		test.Fatalf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestMetrics(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url, "localhost:1")
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		t := task.Task{ID: uuid.New(), Name: fmt.Sprintf("test-container-%d", i), Image: "strm/helloworld-http"}
+		m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	}
+	// Round robin sends the first task to the unreachable worker, which
+	// puts it back in the queue.
+	m.SendWork()
+	m.SendWork()
+	runQueued(test, w)
+	m.updateTasks()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		test.Fatalf("Error getting metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, expected := range []string{
+		`cube_manager_tasks{state="Running"} 1`,
+		`cube_manager_pending_events 1`,
+		`cube_manager_scheduling_latency_seconds_count 1`,
+		`cube_manager_worker_errors_total{call="send_work",worker="localhost:1"} 1`,
+		`cube_manager_worker_errors_total{call="update_tasks",worker="localhost:1"} 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			test.Fatalf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestTaskLogsProxy(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url)
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := task.Task{ID: uuid.New(), Name: "test-container", State: task.Scheduled, Image: "strm/helloworld-http"}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	m.SendWork()
+	runQueued(test, w)
+	m.updateTasks()
+	running, _ := m.taskDb.Get(t.ID.String())
+	w.Runtime.(*task.FakeRuntime).SetLogs(running.ContainerID, "hello\n", "")
+
+	// Following never ends by itself, so the output has to be streamed.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/tasks/"+t.ID.String()+"/logs?follow=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		test.Fatalf("Error getting logs: %v", err)
+	}
+	defer resp.Body.Close()
+	line := make([]byte, len("hello\n"))
+	if _, err := io.ReadFull(resp.Body, line); err != nil || string(line) != "hello\n" {
+		test.Fatalf("Expected streamed logs, got %q (%v)", line, err)
+	}
+
+	resp, _ = http.Get(server.URL + "/tasks/" + uuid.New().String() + "/logs")
+	if resp.StatusCode != http.StatusNotFound {
+		test.Fatalf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestExecProxy(test *testing.T) {
+	w, url := newWorker(test)
+	m := newManager(test, url)
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := task.Task{ID: uuid.New(), Name: "test-container", State: task.Scheduled, Image: "strm/helloworld-http"}
+	m.AddTask(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	m.SendWork()
+	runQueued(test, w)
+	m.updateTasks()
+	w.Runtime.(*task.FakeRuntime).ExecHandler = func(id string, cmd []string) task.ExecResult {
+		return task.ExecResult{Stdout: strings.Join(cmd, " ")}
+	}
+
+	data, _ := json.Marshal(worker.ExecRequest{Cmd: []string{"echo", "hi"}})
+	resp, err := http.Post(server.URL+"/tasks/"+t.ID.String()+"/exec", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		test.Fatalf("Error running exec: %v", err)
+	}
+	result := task.ExecResult{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || result.Stdout != "echo hi" {
+		test.Fatalf("Unexpected exec result %v with status %d", result, resp.StatusCode)
+	}
+
+	// The interactive session is upgraded to a websocket through the proxy.
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/tasks/" + t.ID.String() + "/exec/ws?cmd=cat"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		test.Fatalf("Error connecting to %v: %v", wsURL, err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(worker.ExecMessage{Stream: worker.StdinStream, Data: "hello\n"})
+	conn.WriteJSON(worker.ExecMessage{Stream: worker.StdinStream, Close: true})
+	for _, expected := range []worker.ExecMessage{
+		{Stream: worker.StdoutStream, Data: "hello\n"},
+		{Stream: worker.ExitStream},
+	} {
+		msg := worker.ExecMessage{}
+		if err := conn.ReadJSON(&msg); err != nil || msg != expected {
+			test.Fatalf("Expected %v, got %v (%v)", expected, msg, err)
+		}
+	}
+
+	resp, _ = http.Post(server.URL+"/tasks/"+uuid.New().String()+"/exec", "application/json", bytes.NewBuffer(data))
+	if resp.StatusCode != http.StatusNotFound {
+		test.Fatalf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestConcurrentAccess(test *testing.T) {
+	w, url := newWorker(test)
+	w.RunPeriod, w.UpdatePeriod = 10*time.Millisecond, 10*time.Millisecond
+	m := newManager(test, url)
+	m.ProcessPeriod, m.UpdatePeriod = 10*time.Millisecond, 10*time.Millisecond
+	api := Api{Manager: m}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	for _, run := range []func(context.Context){
+		w.RunTasks, w.UpdateTasks, w.CollectStats,
+		m.ProcessTasks, m.UpdateTasks, m.UpdateNodeStats, m.DoHealthChecks, m.CheckNodes,
+	} {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			run(ctx)
+		}()
+	}
+
+	var clients sync.WaitGroup
+	ids := make(chan uuid.UUID, 40)
+	for i := 0; i < 4; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 10; j++ {
+				t := task.Task{ID: uuid.New(), Name: fmt.Sprintf("test-container-%d-%d", i, j), Image: "strm/helloworld-http"}
+				data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+				resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+				if err != nil {
+					test.Errorf("Error posting task: %v", err)
+					return
+				}
+				resp.Body.Close()
+				ids <- t.ID
+
+				for _, path := range []string{"/tasks", "/nodes", "/metrics", "/tasks/" + t.ID.String()} {
+					resp, err := http.Get(server.URL + path)
+					if err != nil {
+						test.Errorf("Error getting %s: %v", path, err)
+						return
+					}
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+	clients.Wait()
+	close(ids)
+
+	waitForTasks(test, m, 40, task.Running)
+	for id := range ids {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			req, _ := http.NewRequest(http.MethodDelete, server.URL+"/tasks/"+id.String(), nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				test.Errorf("Error stopping task: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	clients.Wait()
+	waitForTasks(test, m, 40, task.Completed)
+
+	cancel()
+	loops.Wait()
+}
+
+// waitForTasks waits until count tasks of the manager are in the state.
+func waitForTasks(test *testing.T, m *Manager, count int, state task.State) {
+	deadline := time.Now().Add(10 * time.Second)
 	for {
-		for _, t := range m.TaskDb {
-			fmt.Printf("[Manager] Task: id: %s, state: %d\n", t.ID, t.State)
-			time.Sleep(15 * time.Second)
+		n := 0
+		for _, t := range m.GetTasks() {
+			if t.State == state {
+				n++
+			}
+		}
+		if n == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			test.Fatalf("Expected %d tasks in state %v, got %d", count, state, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newWorker(test *testing.T) (*worker.Worker, string) {
+	w, err := worker.New("test-worker", "memory", task.NewFakeRuntime())
+	if err != nil {
+		test.Fatalf("Error creating worker: %v", err)
+	}
+	api := worker.Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	test.Cleanup(server.Close)
+	return w, strings.TrimPrefix(server.URL, "http://")
+}
+
+func newManager(test *testing.T, workers ...string) *Manager {
+	m, err := New(workers, "roundrobin", "memory")
+	if err != nil {
+		test.Fatalf("Error creating manager: %v", err)
+	}
+	return m
+}
+
+func runQueued(test *testing.T, w *worker.Worker) {
+	for w.Queue.Len() > 0 {
+		result := w.RunTask()
+		if result.Error != nil {
+			test.Fatalf("Error running task: %v", result.Error)
 		}
 	}
 }
@@ -0,0 +1,87 @@
+package manager
+
+import (
+	"dumch/cube/stats"
+	"dumch/cube/task"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the prometheus metrics of a manager, served at /metrics.
+type metrics struct {
+	registry          *prometheus.Registry
+	tasks             *prometheus.GaugeVec
+	pending           prometheus.Gauge
+	schedulingLatency prometheus.Histogram
+	workerErrors      *prometheus.CounterVec
+}
+
+func newMetrics(m *Manager) *metrics {
+	mt := metrics{
+		registry: prometheus.NewRegistry(),
+		tasks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cube_manager_tasks",
+			Help: "Number of tasks known to the manager, by state.",
+		}, []string{"state"}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cube_manager_pending_events",
+			Help: "Number of task events waiting to be sent to workers.",
+		}),
+		schedulingLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "cube_manager_scheduling_latency_seconds",
+			Help:    "Time from a task event being queued until it was sent to a worker.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+		}),
+		workerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cube_manager_worker_errors_total",
+			Help: "Failed calls to worker apis, by worker and call.",
+		}, []string{"worker", "call"}),
+	}
+	mt.registry.MustRegister(mt.tasks, mt.pending, mt.schedulingLatency, mt.workerErrors,
+		stats.NewCollector(m.nodeStats))
+	return &mt
+}
+
+// observeScheduled records the latency of an event that was sent to a worker.
+func (mt *metrics) observeScheduled(te task.TaskEvent) {
+	if mt == nil || te.Timestamp.IsZero() {
+		return
+	}
+	mt.schedulingLatency.Observe(time.Since(te.Timestamp).Seconds())
+}
+
+// workerError counts a failed call to a worker, e.g. "send_work".
+func (mt *metrics) workerError(worker string, call string) {
+	if mt == nil {
+		return
+	}
+	mt.workerErrors.WithLabelValues(worker, call).Inc()
+}
+
+// nodeStats returns the last stats of every worker node, by name.
+func (m *Manager) nodeStats() map[string]*stats.Stats {
+	s := make(map[string]*stats.Stats)
+	for _, n := range m.GetNodes() {
+		s[n.Name] = n.Stats
+	}
+	return s
+}
+
+// MetricsHandler serves the manager's metrics in the prometheus text format.
+func (m *Manager) MetricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(m.metrics.registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts := make(map[task.State]int)
+		for _, t := range m.GetTasks() {
+			counts[t.State]++
+		}
+		for _, state := range task.States {
+			m.metrics.tasks.WithLabelValues(state.String()).Set(float64(counts[state]))
+		}
+		m.metrics.pending.Set(float64(m.Pending.Len()))
+		handler.ServeHTTP(w, r)
+	})
+}
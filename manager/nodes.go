@@ -0,0 +1,302 @@
+package manager
+
+import (
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/node"
+	"dumch/cube/stats"
+	"dumch/cube/task"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultNodeTimeout     = 30 * time.Second
+	DefaultNodeRemoveAfter = 5 * time.Minute
+)
+
+var (
+	ErrUnknownNode  = errors.New("unknown node")
+	ErrPortConflict = errors.New("requested host ports are in use")
+	ErrTaskTooLarge = errors.New("task requests more resources than any node has")
+)
+
+// RegisterNode adds a worker node, or marks an already known one as ready.
+// Workers are identified by the "host:port" address their api listens on.
+func (m *Manager) RegisterNode(n *node.Node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n.Api == "" {
+		n.Api = fmt.Sprintf("http://%s", n.Name)
+	}
+	n.Status = node.Ready
+	n.LastHeartbeat = time.Now().UTC()
+
+	for i, existing := range m.workerNodes {
+		if existing.Name == n.Name {
+			log.Printf("Node %v registered again\n", n.Name)
+			m.workerNodes[i] = n
+			return
+		}
+	}
+
+	log.Printf("Registered node %v\n", n.Name)
+	m.workers = append(m.workers, n.Name)
+	m.workerNodes = append(m.workerNodes, n)
+	if _, ok := m.workerTasks[n.Name]; !ok {
+		m.workerTasks[n.Name] = []uuid.UUID{}
+	}
+}
+
+// Heartbeat records that the named node is alive, along with its stats.
+func (m *Manager) Heartbeat(name string, s *stats.Stats) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.findNode(name)
+	if n == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownNode, name)
+	}
+	if n.Status != node.Ready {
+		log.Printf("Node %v is ready again\n", name)
+	}
+	n.Status = node.Ready
+	n.LastHeartbeat = time.Now().UTC()
+	if s != nil && s.MemStats != nil {
+		n.UpdateStats(s)
+	}
+	return nil
+}
+
+func (m *Manager) CheckNodes(ctx context.Context) {
+	loop.Run(ctx, 10*time.Second, nil, func() {
+		log.Println("Checking node heartbeats")
+		m.checkNodes()
+	})
+}
+
+// checkNodes marks registered nodes that missed their heartbeats as not
+// ready, and removes them altogether once NodeRemoveAfter passed. Nodes
+// that never sent a heartbeat, like the ones passed to New, are left alone.
+func (m *Manager) checkNodes() {
+	now := time.Now().UTC()
+	var removed []string
+
+	m.mu.Lock()
+	var nodes []*node.Node
+	for _, n := range m.workerNodes {
+		silence := now.Sub(n.LastHeartbeat)
+		switch {
+		case n.LastHeartbeat.IsZero():
+		case silence > m.NodeRemoveAfter:
+			log.Printf("Removing node %v, no heartbeat for %v\n", n.Name, silence)
+			removed = append(removed, n.Name)
+			continue
+		case silence > m.NodeTimeout && n.Status == node.Ready:
+			log.Printf("Node %v is not ready, no heartbeat for %v\n", n.Name, silence)
+			n.Status = node.NotReady
+		}
+		nodes = append(nodes, n)
+	}
+	m.workerNodes = nodes
+
+	var workers []string
+	for _, n := range nodes {
+		workers = append(workers, n.Name)
+	}
+	m.workers = workers
+	m.mu.Unlock()
+
+	for _, name := range removed {
+		m.failNodeTasks(name)
+	}
+}
+
+// failNodeTasks marks the tasks that were placed on a removed node as
+// failed, so that they are rescheduled according to their restart policy.
+func (m *Manager) failNodeTasks(name string) {
+	m.mu.Lock()
+	var ids []uuid.UUID
+	for _, id := range m.workerTasks[name] {
+		if m.taskWorkers[id] == name {
+			delete(m.taskWorkers, id)
+			ids = append(ids, id)
+		}
+	}
+	delete(m.workerTasks, name)
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		err := m.updateTask(id, func(t *task.Task) bool {
+			if !task.ValidStateTransition(t.State, task.Failed) || t.State == task.Failed {
+				return false
+			}
+			log.Printf("Task %v was running on removed node %v, marking it failed\n", id, name)
+			t.State = task.Failed
+			t.FinishTime = time.Now().UTC()
+			t.Reason = fmt.Sprintf("node %v was removed", name)
+			return true
+		})
+		if err != nil {
+			log.Printf("Error failing task %v: %v\n", id, err)
+		}
+	}
+}
+
+// updateNodeAllocations recomputes the resources allocated on each node
+// from the scheduled and running tasks placed on it.
+func (m *Manager) updateNodeAllocations() {
+	tasks := m.GetTasks()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range m.workerNodes {
+		n.CpuAllocated = 0
+		n.MemoryAllocated = 0
+		n.DiskAllocated = 0
+		n.TaskCount = 0
+	}
+	for _, t := range tasks {
+		if t.State != task.Scheduled && t.State != task.Running {
+			continue
+		}
+		n := m.findNode(m.taskWorkers[t.ID])
+		if n == nil {
+			continue
+		}
+		n.CpuAllocated += t.Cpu
+		n.MemoryAllocated += t.Memory
+		n.DiskAllocated += t.Disk
+		n.TaskCount++
+	}
+}
+
+// GetNodes returns copies of all worker nodes.
+func (m *Manager) GetNodes() []*node.Node {
+	m.updateNodeAllocations()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := []*node.Node{}
+	for _, n := range m.workerNodes {
+		c := *n
+		nodes = append(nodes, &c)
+	}
+	return nodes
+}
+
+// GetNode returns a copy of the named worker node.
+func (m *Manager) GetNode(name string) (*node.Node, error) {
+	m.updateNodeAllocations()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := m.findNode(name)
+	if n == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNode, name)
+	}
+	c := *n
+	return &c, nil
+}
+
+// setNodeStats records stats polled from the named node.
+func (m *Manager) setNodeStats(name string, s *stats.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := m.findNode(name); n != nil {
+		n.UpdateStats(s)
+	}
+}
+
+// Admit checks that t would fit on at least one node if that node ran
+// nothing else, so that tasks that can never be scheduled are rejected
+// rather than queued forever. Capacities that are not known yet, e.g.
+// before the first stats of a node arrived, do not limit tasks.
+func (m *Manager) Admit(t task.Task) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.workerNodes) == 0 {
+		return nil
+	}
+	for _, n := range m.workerNodes {
+		if (n.Cores == 0 || t.Cpu <= float64(n.Cores)) &&
+			(n.Memory == 0 || t.Memory <= n.Memory) &&
+			(n.Disk == 0 || t.Disk <= n.Disk) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: cpu %v, memory %d bytes, disk %d bytes", ErrTaskTooLarge, t.Cpu, t.Memory, t.Disk)
+}
+
+// withFreePorts returns the nodes on which none of the host ports t
+// requested are requested by or bound to other scheduled or running tasks.
+func (m *Manager) withFreePorts(t task.Task, nodes []*node.Node) []*node.Node {
+	requested := t.RequestedHostPorts()
+	if len(requested) == 0 {
+		return nodes
+	}
+
+	tasks := m.GetTasks()
+	used := make(map[string]map[nat.Port]bool)
+	m.mu.RLock()
+	for _, other := range tasks {
+		if other.ID == t.ID || (other.State != task.Scheduled && other.State != task.Running) {
+			continue
+		}
+		w, ok := m.taskWorkers[other.ID]
+		if !ok {
+			continue
+		}
+		if used[w] == nil {
+			used[w] = make(map[nat.Port]bool)
+		}
+		for _, p := range other.BoundHostPorts() {
+			used[w][p] = true
+		}
+	}
+	m.mu.RUnlock()
+
+	var free []*node.Node
+	for _, n := range nodes {
+		if !slices.ContainsFunc(requested, func(p nat.Port) bool { return used[n.Name][p] }) {
+			free = append(free, n)
+		}
+	}
+	return free
+}
+
+// readyNodes returns copies of the nodes tasks can currently be scheduled
+// on.
+func (m *Manager) readyNodes() []*node.Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var nodes []*node.Node
+	for _, n := range m.workerNodes {
+		if n.Status != node.NotReady {
+			c := *n
+			nodes = append(nodes, &c)
+		}
+	}
+	return nodes
+}
+
+// Workers returns a snapshot of the known worker addresses.
+func (m *Manager) Workers() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.workers...)
+}
+
+func (m *Manager) findNode(name string) *node.Node {
+	for _, n := range m.workerNodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// GetTaskLogsHandler streams the logs of a task from the worker running it.
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	a.proxyToWorker(w, r)
+}
+
+// ExecTaskHandler runs a command in a task's container on the worker running
+// it, either at once or interactively over a websocket.
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	a.proxyToWorker(w, r)
+}
+
+// proxyToWorker forwards a request for a task, as is, to the same path on
+// the worker the task is placed on. Responses are streamed back.
+func (a *Api) proxyToWorker(w http.ResponseWriter, r *http.Request) {
+	taskID, _ := uuid.Parse(chi.URLParam(r, "taskID"))
+	worker, ok := a.Manager.TaskWorker(taskID)
+	if !ok {
+		log.Printf("Task %v is not placed on any worker\n", taskID)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	target, err := url.Parse(fmt.Sprintf("http://%s", worker))
+	if err != nil {
+		log.Printf("Invalid worker address %v: %v\n", worker, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	proxy := httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Error proxying %v to worker %v: %v\n", r.URL.Path, worker, err)
+			a.Manager.metrics.workerError(worker, "proxy")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"dumch/cube/task"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultRestartBackoff    = 10 * time.Second
+	DefaultMaxRestartBackoff = 5 * time.Minute
+)
+
+// restartFailedTasks puts failed tasks whose restart policy allows it back
+// on the pending queue, so the scheduler can place them on any worker.
+func (m *Manager) restartFailedTasks() {
+	now := time.Now().UTC()
+	for _, t := range m.GetTasks() {
+		var restarted *task.Task
+		err := m.updateTask(t.ID, func(t *task.Task) bool {
+			if t.State != task.Failed || !restartOnFailure(t.RestartPolicy) {
+				return false
+			}
+			if t.RestartCount >= m.MaxRestarts {
+				return false
+			}
+			if next := t.FinishTime.Add(m.restartBackoff(t.RestartCount)); now.Before(next) {
+				log.Printf("Task %v will be restarted after %v\n", t.ID, next)
+				return false
+			}
+			if !task.ValidRestartTransition(t.State, task.Scheduled) {
+				return false
+			}
+
+			log.Printf("Rescheduling failed task %v (restart %d)\n", t.ID, t.RestartCount+1)
+			if w, ok := m.TaskWorker(t.ID); ok {
+				m.unassignTask(w, t.ID)
+			}
+			t.State = task.Scheduled
+			t.RestartCount++
+			t.HealthFailures = 0
+			restarted = t
+			return true
+		})
+		if err != nil {
+			log.Printf("Error restarting task %v: %v\n", t.ID, err)
+			continue
+		}
+		if restarted == nil {
+			continue
+		}
+
+		m.AddTask(task.TaskEvent{
+			ID:        uuid.New(),
+			State:     task.Running,
+			Timestamp: now,
+			Task:      *restarted,
+		})
+	}
+}
+
+// restartBackoff is the delay before the restart following restartCount
+// earlier ones.
+func (m *Manager) restartBackoff(restartCount int) time.Duration {
+	backoff := m.RestartBackoff
+	for i := 0; i < restartCount && backoff < m.MaxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, m.MaxRestartBackoff)
+}
+
+func restartOnFailure(policy string) bool {
+	switch policy {
+	case "always", "unless-stopped", "on-failure":
+		return true
+	default:
+		return false
+	}
+}
@@ -1,13 +1,86 @@
 package node
 
+import (
+	"dumch/cube/stats"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type Status string
+
+const (
+	Ready    Status = "Ready"
+	NotReady Status = "NotReady"
+)
+
 type Node struct {
 	Name            string
 	Ip              string
+	Api             string
 	Cores           int
-	Memory          int
-	MemoryAllocated int
-	Disk            int
-	DiskAllocated   int
+	CpuAllocated    float64
+	Memory          int64
+	MemoryAllocated int64
+	Disk            int64
+	DiskAllocated   int64
+	Stats           *stats.Stats
 	Role            string
 	TaskCount       int
+	Status          Status
+	LastHeartbeat   time.Time
+}
+
+// NewNode creates a node reachable at api, e.g. "http://localhost:5555".
+func NewNode(name string, api string, role string) *Node {
+	return &Node{
+		Name:   name,
+		Api:    api,
+		Role:   role,
+		Status: Ready,
+	}
+}
+
+func (n *Node) CpuFree() float64  { return float64(n.Cores) - n.CpuAllocated }
+func (n *Node) MemoryFree() int64 { return n.Memory - n.MemoryAllocated }
+func (n *Node) DiskFree() int64   { return n.Disk - n.DiskAllocated }
+
+// GetStats fetches the current stats from the node's worker and updates
+// the node with them.
+func (n *Node) GetStats() (*stats.Stats, error) {
+	url := fmt.Sprintf("%s/stats", n.Api)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %v: %w", n.Api, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("retrieving stats from %v: status %d", n.Api, resp.StatusCode)
+	}
+
+	var s stats.Stats
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("decoding stats for node %s: %w", n.Name, err)
+	}
+
+	n.UpdateStats(&s)
+	return &s, nil
+}
+
+// UpdateStats records stats reported by the node's worker and updates the
+// node's cpu, memory and disk capacity from them.
+func (n *Node) UpdateStats(s *stats.Stats) {
+	if s.CpuCount > 0 {
+		n.Cores = s.CpuCount
+	}
+	if s.MemStats != nil {
+		n.Memory = int64(s.MemStats.Total)
+	}
+	if s.DiskStats != nil {
+		n.Disk = int64(s.DiskTotal())
+	}
+	n.Stats = s
 }
@@ -0,0 +1,38 @@
+// Package queue provides a FIFO queue that is safe for concurrent use.
+package queue
+
+import (
+	"sync"
+
+	collections "github.com/golang-collections/collections/queue"
+)
+
+// Queue is a FIFO queue of T. The zero value is an empty queue.
+type Queue[T any] struct {
+	mu sync.Mutex
+	q  collections.Queue
+}
+
+func (q *Queue[T]) Enqueue(value T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.q.Enqueue(value)
+}
+
+// Dequeue removes and returns the oldest value, or false if the queue is
+// empty.
+func (q *Queue[T]) Dequeue() (T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var value T
+	if q.q.Len() == 0 {
+		return value, false
+	}
+	return q.q.Dequeue().(T), true
+}
+
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.q.Len()
+}
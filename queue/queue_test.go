@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestQueue(test *testing.T) {
+	var q Queue[int]
+	if _, ok := q.Dequeue(); ok {
+		test.Fatalf("Expected empty queue")
+	}
+	for i := 0; i < 3; i++ {
+		q.Enqueue(i)
+	}
+	for i := 0; i < 3; i++ {
+		if v, ok := q.Dequeue(); !ok || v != i {
+			test.Fatalf("Expected %d, got %d", i, v)
+		}
+	}
+}
+
+func TestConcurrentQueue(test *testing.T) {
+	var q Queue[int]
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				q.Enqueue(j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				q.Dequeue()
+				q.Len()
+			}
+		}()
+	}
+	wg.Wait()
+	if q.Len() < 400 {
+		test.Fatalf("Expected at least 400 values left, got %d", q.Len())
+	}
+}
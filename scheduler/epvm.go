@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"dumch/cube/node"
+	"dumch/cube/task"
+	"math"
+)
+
+// LIEB is the base of the E-PVM cost function. Each resource costs
+// LIEB^utilisation, so the marginal cost of a task grows quickly as a node
+// gets busier.
+const LIEB = 1.53960071783900203869
+
+// maxJobs is the task count at which a node's job load is considered full.
+const maxJobs = 4.0
+
+// Epvm implements the Enhanced Parallel Virtual Machine opportunity cost
+// algorithm: a task goes to the node where adding its cpu and memory load
+// costs the least, based on the node's live stats.
+type Epvm struct {
+	Name string
+}
+
+func (e *Epvm) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	var candidates []*node.Node
+	for _, n := range nodes {
+		if n.Stats == nil || n.Stats.MemStats == nil {
+			continue
+		}
+		if t.Memory > 0 && int64(n.Stats.MemStats.Available) < t.Memory {
+			continue
+		}
+		if t.Disk > 0 && n.Stats.DiskStats != nil && int64(n.Stats.DiskFree()) < t.Disk {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	return candidates
+}
+
+func (e *Epvm) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, n := range nodes {
+		cpu := cpuLoad(n)
+		cpuAfter := cpu + t.Cpu/float64(max(n.Cores, 1))
+
+		mem := memLoad(n, 0)
+		memAfter := memLoad(n, t.Memory)
+
+		jobLoad := float64(n.TaskCount) / maxJobs
+		jobLoadAfter := float64(n.TaskCount+1) / maxJobs
+
+		cpuCost := math.Pow(LIEB, cpuAfter) - math.Pow(LIEB, cpu)
+		memCost := math.Pow(LIEB, memAfter) - math.Pow(LIEB, mem)
+		jobCost := math.Pow(LIEB, jobLoadAfter) - math.Pow(LIEB, jobLoad)
+
+		scores[n.Name] = cpuCost + memCost + jobCost
+	}
+	return scores
+}
+
+func (e *Epvm) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
+
+// cpuLoad returns the node's cpu utilisation in the 0..1 range, falling
+// back to the 1 minute load average when no cpu usage was reported.
+func cpuLoad(n *node.Node) float64 {
+	if n.Stats == nil {
+		return 0
+	}
+	if n.Stats.CpuStats != nil {
+		return n.Stats.CpuStats.Usage
+	}
+	if n.Stats.LoadStats != nil && len(n.Stats.LoadStats.Avg) > 0 {
+		return n.Stats.LoadStats.Avg[0] / float64(max(n.Cores, 1))
+	}
+	return 0
+}
+
+// memLoad returns the node's memory utilisation in the 0..1 range after
+// extra bytes are added to what is currently in use.
+func memLoad(n *node.Node, extra int64) float64 {
+	if n.Stats == nil || n.Stats.MemStats == nil || n.Stats.MemStats.Total == 0 {
+		return 0
+	}
+	used := float64(n.Stats.MemStats.Total-n.Stats.MemStats.Available) + float64(extra)
+	return used / float64(n.Stats.MemStats.Total)
+}
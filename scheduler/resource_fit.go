@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"dumch/cube/node"
+	"dumch/cube/task"
+)
+
+// ResourceFit only considers nodes with enough free cpu, memory and disk
+// for the task, and prefers the node that stays least utilised after the
+// task is placed on it.
+type ResourceFit struct {
+	Name string
+}
+
+func (r *ResourceFit) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	var candidates []*node.Node
+	for _, n := range nodes {
+		if fits(t, n) {
+			candidates = append(candidates, n)
+		}
+	}
+	return candidates
+}
+
+func (r *ResourceFit) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, n := range nodes {
+		var total float64
+		var dims int
+		if n.Cores > 0 {
+			total += (n.CpuAllocated + t.Cpu) / float64(n.Cores)
+			dims++
+		}
+		if n.Memory > 0 {
+			total += float64(n.MemoryAllocated+t.Memory) / float64(n.Memory)
+			dims++
+		}
+		if n.Disk > 0 {
+			total += float64(n.DiskAllocated+t.Disk) / float64(n.Disk)
+			dims++
+		}
+		if dims > 0 {
+			scores[n.Name] = total / float64(dims)
+		} else {
+			scores[n.Name] = 0
+		}
+	}
+	return scores
+}
+
+func (r *ResourceFit) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
+
+func fits(t task.Task, n *node.Node) bool {
+	if t.Cpu > 0 && n.CpuFree() < t.Cpu {
+		return false
+	}
+	if t.Memory > 0 && n.MemoryFree() < t.Memory {
+		return false
+	}
+	if t.Disk > 0 && n.DiskFree() < t.Disk {
+		return false
+	}
+	return true
+}
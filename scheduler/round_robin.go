@@ -0,0 +1,36 @@
+package scheduler
+
+import (
+	"dumch/cube/node"
+	"dumch/cube/task"
+)
+
+type RoundRobin struct {
+	Name       string
+	LastWorker int
+}
+
+func (r *RoundRobin) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	return nodes
+}
+
+func (r *RoundRobin) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	scores := make(map[string]float64)
+	if r.LastWorker+1 < len(nodes) {
+		r.LastWorker++
+	} else {
+		r.LastWorker = 0
+	}
+	for i, n := range nodes {
+		if i == r.LastWorker {
+			scores[n.Name] = 0.1
+		} else {
+			scores[n.Name] = 1.0
+		}
+	}
+	return scores
+}
+
+func (r *RoundRobin) Pick(scores map[string]float64, candidates []*node.Node) *node.Node {
+	return pickLowest(scores, candidates)
+}
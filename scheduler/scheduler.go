@@ -1,7 +1,52 @@
 package scheduler
 
+import (
+	"dumch/cube/node"
+	"dumch/cube/task"
+	"fmt"
+)
+
+// Scheduler decides which node a task should run on. Scores are costs:
+// the candidate with the lowest score is picked.
 type Scheduler interface {
-	SelectCandidateNodes()
-	Score()
-	Pick()
+	SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node
+	Score(t task.Task, nodes []*node.Node) map[string]float64
+	Pick(scores map[string]float64, candidates []*node.Node) *node.Node
+}
+
+const (
+	RoundRobinType  = "roundrobin"
+	ResourceFitType = "resource"
+	EpvmType        = "epvm"
+)
+
+func New(schedulerType string) (Scheduler, error) {
+	switch schedulerType {
+	case "", RoundRobinType:
+		return &RoundRobin{Name: RoundRobinType}, nil
+	case ResourceFitType:
+		return &ResourceFit{Name: ResourceFitType}, nil
+	case EpvmType:
+		return &Epvm{Name: EpvmType}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler type %q", schedulerType)
+	}
+}
+
+// pickLowest returns the candidate with the lowest score, preferring the
+// earlier candidate on ties. Candidates without a score are ignored.
+func pickLowest(scores map[string]float64, candidates []*node.Node) *node.Node {
+	var best *node.Node
+	var bestScore float64
+	for _, n := range candidates {
+		score, ok := scores[n.Name]
+		if !ok {
+			continue
+		}
+		if best == nil || score < bestScore {
+			best = n
+			bestScore = score
+		}
+	}
+	return best
 }
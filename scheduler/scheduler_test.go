@@ -0,0 +1,134 @@
+package scheduler
+
+import (
+	"dumch/cube/node"
+	"dumch/cube/stats"
+	"dumch/cube/task"
+	"testing"
+
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
+)
+
+func newNodes() []*node.Node {
+	return []*node.Node{
+		{Name: "w1", Cores: 2, Memory: 1 << 30, Disk: 10 << 30},
+		{Name: "w2", Cores: 4, Memory: 4 << 30, Disk: 10 << 30},
+		{Name: "w3", Cores: 1, Memory: 512 << 20, Disk: 1 << 30},
+	}
+}
+
+func schedule(s Scheduler, t task.Task, nodes []*node.Node) *node.Node {
+	candidates := s.SelectCandidateNodes(t, nodes)
+	return s.Pick(s.Score(t, candidates), candidates)
+}
+
+func TestRoundRobin(test *testing.T) {
+	s, err := New(RoundRobinType)
+	if err != nil {
+		test.Fatalf("Error creating scheduler: %v", err)
+	}
+	nodes := newNodes()
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		picked = append(picked, schedule(s, task.Task{}, nodes).Name)
+	}
+
+	expected := []string{"w2", "w3", "w1", "w2"}
+	for i := range expected {
+		if picked[i] != expected[i] {
+			test.Fatalf("Expected %v, got %v", expected, picked)
+		}
+	}
+}
+
+func TestResourceFitFiltersNodes(test *testing.T) {
+	s, _ := New(ResourceFitType)
+	nodes := newNodes()
+	nodes[1].MemoryAllocated = 4 << 30
+
+	t := task.Task{Cpu: 1.5, Memory: 256 << 20}
+	candidates := s.SelectCandidateNodes(t, nodes)
+	if len(candidates) != 1 || candidates[0].Name != "w1" {
+		test.Fatalf("Expected only w1 to fit, got %v", candidates)
+	}
+
+	t = task.Task{Disk: 20 << 30}
+	if n := schedule(s, t, nodes); n != nil {
+		test.Fatalf("Expected no node to fit, got %v", n.Name)
+	}
+}
+
+func TestResourceFitPrefersLeastUtilised(test *testing.T) {
+	s, _ := New(ResourceFitType)
+	nodes := newNodes()
+
+	n := schedule(s, task.Task{Cpu: 0.5, Memory: 256 << 20}, nodes)
+	if n == nil || n.Name != "w2" {
+		test.Fatalf("Expected w2, got %v", n)
+	}
+}
+
+func newStatsNode(name string, cores int, cpuUsage float64, memTotal, memAvailable uint64) *node.Node {
+	return &node.Node{
+		Name:   name,
+		Cores:  cores,
+		Memory: int64(memTotal),
+		Stats: &stats.Stats{
+			MemStats:  &mem.VirtualMemoryStat{Total: memTotal, Available: memAvailable},
+			DiskStats: &disk.UsageStat{Total: 100 << 30, Free: 50 << 30},
+			CpuStats:  &stats.CpuStats{CpuUsage: stats.CpuUsage{Usage: cpuUsage}},
+		},
+	}
+}
+
+func TestEpvmPicksCheapestNode(test *testing.T) {
+	s, _ := New(EpvmType)
+	nodes := []*node.Node{
+		newStatsNode("busy", 4, 0.9, 8<<30, 1<<30),
+		newStatsNode("idle", 4, 0.1, 8<<30, 7<<30),
+		newStatsNode("half", 4, 0.5, 8<<30, 4<<30),
+	}
+
+	t := task.Task{Cpu: 1, Memory: 512 << 20}
+	scores := s.Score(t, nodes)
+	if !(scores["idle"] < scores["half"] && scores["half"] < scores["busy"]) {
+		test.Fatalf("Expected cost to grow with utilisation, got %v", scores)
+	}
+	if n := schedule(s, t, nodes); n == nil || n.Name != "idle" {
+		test.Fatalf("Expected idle node, got %v", n)
+	}
+}
+
+func TestEpvmSpreadsTasks(test *testing.T) {
+	s, _ := New(EpvmType)
+	nodes := []*node.Node{
+		newStatsNode("w1", 2, 0.2, 4<<30, 3<<30),
+		newStatsNode("w2", 2, 0.2, 4<<30, 3<<30),
+	}
+	nodes[0].TaskCount = 3
+
+	if n := schedule(s, task.Task{Cpu: 0.5}, nodes); n == nil || n.Name != "w2" {
+		test.Fatalf("Expected node with fewer tasks, got %v", n)
+	}
+}
+
+func TestEpvmSkipsNodesWithoutCapacity(test *testing.T) {
+	s, _ := New(EpvmType)
+	noStats := &node.Node{Name: "unknown"}
+	full := newStatsNode("full", 2, 0.1, 4<<30, 100<<20)
+	ok := newStatsNode("ok", 2, 0.8, 4<<30, 2<<30)
+
+	t := task.Task{Memory: 1 << 30}
+	candidates := s.SelectCandidateNodes(t, []*node.Node{noStats, full, ok})
+	if len(candidates) != 1 || candidates[0].Name != "ok" {
+		test.Fatalf("Expected only ok node to be a candidate, got %v", candidates)
+	}
+}
+
+func TestUnknownScheduler(test *testing.T) {
+	if _, err := New("random"); err == nil {
+		test.Fatalf("Expected an error for unknown scheduler type")
+	}
+}
@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CpuUsage is the share of cpu time, in the 0..1 range, spent in each
+// state between two samples. Usage is everything but Idle and Iowait.
+type CpuUsage struct {
+	Usage  float64
+	User   float64
+	System float64
+	Iowait float64
+	Idle   float64
+}
+
+type CpuStats struct {
+	CpuUsage
+	Cores []CpuUsage
+}
+
+// cpuTimes are the jiffies a cpu spent in each state, as listed in a
+// /proc/stat "cpu" line.
+type cpuTimes struct {
+	User, Nice, System, Idle, Iowait, Irq, Softirq, Steal uint64
+}
+
+func (t cpuTimes) total() uint64 {
+	return t.User + t.Nice + t.System + t.Idle + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// usageSince computes the cpu usage between an earlier sample and t.
+func (t cpuTimes) usageSince(prev cpuTimes) CpuUsage {
+	total := float64(t.total()) - float64(prev.total())
+	if total <= 0 {
+		return CpuUsage{Idle: 1}
+	}
+	share := func(now, before uint64) float64 {
+		return (float64(now) - float64(before)) / total
+	}
+	u := CpuUsage{
+		User:   share(t.User+t.Nice, prev.User+prev.Nice),
+		System: share(t.System+t.Irq+t.Softirq, prev.System+prev.Irq+prev.Softirq),
+		Iowait: share(t.Iowait, prev.Iowait),
+		Idle:   share(t.Idle, prev.Idle),
+	}
+	u.Usage = 1 - u.Idle - u.Iowait
+	return u
+}
+
+// CpuSampler computes cpu usage from the difference between consecutive
+// reads of /proc/stat. The first sample covers the time since boot. Without
+// a Root of its own, it reads the procfs set with SetProcFS.
+type CpuSampler struct {
+	ProcFS
+
+	mu        sync.Mutex
+	prevTotal cpuTimes
+	prevCores []cpuTimes
+}
+
+func (c *CpuSampler) Sample() (*CpuStats, error) {
+	p := c.ProcFS
+	if p.Root == "" {
+		p = procfs
+	}
+	path := p.path("stat")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	total, cores, err := parseProcStat(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := CpuStats{CpuUsage: total.usageSince(c.prevTotal)}
+	for i, core := range cores {
+		var prev cpuTimes
+		if i < len(c.prevCores) {
+			prev = c.prevCores[i]
+		}
+		s.Cores = append(s.Cores, core.usageSince(prev))
+	}
+	c.prevTotal, c.prevCores = total, cores
+	return &s, nil
+}
+
+// parseProcStat reads the aggregate and per-core cpu lines of /proc/stat.
+func parseProcStat(r io.Reader) (cpuTimes, []cpuTimes, error) {
+	var total cpuTimes
+	var cores []cpuTimes
+	found := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+
+		var values [8]uint64
+		for i := 0; i < len(values) && i+1 < len(fields); i++ {
+			v, err := strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return total, nil, fmt.Errorf("invalid %s value %q", fields[0], fields[i+1])
+			}
+			values[i] = v
+		}
+		t := cpuTimes{
+			User: values[0], Nice: values[1], System: values[2], Idle: values[3],
+			Iowait: values[4], Irq: values[5], Softirq: values[6], Steal: values[7],
+		}
+
+		if fields[0] == "cpu" {
+			total = t
+			found = true
+		} else {
+			cores = append(cores, t)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, nil, err
+	}
+	if !found {
+		return total, nil, fmt.Errorf("no cpu line")
+	}
+	return total, cores, nil
+}
@@ -0,0 +1,186 @@
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sample is the stats of a node at a point in time.
+type Sample struct {
+	Time  time.Time
+	Stats *Stats
+}
+
+// History keeps the samples of the last retention period in a ring
+// buffer, assuming one sample per resolution.
+type History struct {
+	mu         sync.RWMutex
+	resolution time.Duration
+	retention  time.Duration
+	samples    []Sample
+	next       int
+	full       bool
+}
+
+// NewHistory creates a history keeping samples taken once per resolution
+// for the retention period, which must not be shorter than resolution.
+func NewHistory(resolution time.Duration, retention time.Duration) (*History, error) {
+	if resolution <= 0 {
+		return nil, fmt.Errorf("resolution %v is not positive", resolution)
+	}
+	if retention < resolution {
+		return nil, fmt.Errorf("retention %v is shorter than resolution %v", retention, resolution)
+	}
+	return &History{
+		resolution: resolution,
+		retention:  retention,
+		samples:    make([]Sample, int(retention/resolution)),
+	}, nil
+}
+
+// Resolution is how often samples are expected to be added.
+func (h *History) Resolution() time.Duration { return h.resolution }
+
+// Retention is how long samples are kept.
+func (h *History) Retention() time.Duration { return h.retention }
+
+// Add records a sample, overwriting the oldest one once the buffer is full.
+func (h *History) Add(t time.Time, s *Stats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = Sample{Time: t, Stats: s}
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Range returns the samples taken between since and until, oldest first.
+func (h *History) Range(since time.Time, until time.Time) []Sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ordered := h.samples[:h.next]
+	if h.full {
+		ordered = append(append([]Sample{}, h.samples[h.next:]...), ordered...)
+	}
+
+	var samples []Sample
+	for _, s := range ordered {
+		if s.Time.Before(since) || s.Time.After(until) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// Aggregate summarises the values of a stat within a step.
+type Aggregate struct {
+	Min float64
+	Max float64
+	Avg float64
+}
+
+// Point is the downsampled stats of the step starting at Time. Stats that
+// no sample of the step reported are nil.
+type Point struct {
+	Time            time.Time
+	Samples         int
+	CpuUsage        *Aggregate `json:",omitempty"`
+	Load1           *Aggregate `json:",omitempty"`
+	MemoryUsed      *Aggregate `json:",omitempty"`
+	MemoryAvailable *Aggregate `json:",omitempty"`
+	DiskFree        *Aggregate `json:",omitempty"`
+	TaskCount       *Aggregate `json:",omitempty"`
+}
+
+// Downsample aggregates the samples between since and until into points of
+// the given step. Steps without samples are left out.
+func (h *History) Downsample(since time.Time, until time.Time, step time.Duration) []Point {
+	if step <= 0 {
+		step = h.resolution
+	}
+
+	var points []Point
+	var acc *accumulator
+	for _, s := range h.Range(since, until) {
+		start := since.Add(s.Time.Sub(since) / step * step)
+		if acc == nil || !acc.start.Equal(start) {
+			if acc != nil {
+				points = append(points, acc.point())
+			}
+			acc = &accumulator{start: start}
+		}
+		acc.add(s.Stats)
+	}
+	if acc != nil {
+		points = append(points, acc.point())
+	}
+	return points
+}
+
+// accumulator collects the values of the samples of one step.
+type accumulator struct {
+	start   time.Time
+	samples int
+	values  [6]series
+}
+
+type series struct {
+	min, max, sum float64
+	n             int
+}
+
+func (s *series) add(v float64) {
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
+	s.sum += v
+	s.n++
+}
+
+func (s *series) aggregate() *Aggregate {
+	if s.n == 0 {
+		return nil
+	}
+	return &Aggregate{Min: s.min, Max: s.max, Avg: s.sum / float64(s.n)}
+}
+
+func (a *accumulator) add(s *Stats) {
+	a.samples++
+	if s == nil {
+		return
+	}
+	if s.CpuStats != nil {
+		a.values[0].add(s.CpuStats.Usage)
+	}
+	if s.LoadStats != nil && len(s.LoadStats.Avg) > 0 {
+		a.values[1].add(s.LoadStats.Avg[0])
+	}
+	if s.MemStats != nil {
+		a.values[2].add(float64(s.MemStats.Total) - float64(s.MemStats.Available))
+		a.values[3].add(float64(s.MemStats.Available))
+	}
+	if s.DiskStats != nil {
+		a.values[4].add(float64(s.DiskStats.Free))
+	}
+	a.values[5].add(float64(s.TaskCount))
+}
+
+func (a *accumulator) point() Point {
+	return Point{
+		Time:            a.start,
+		Samples:         a.samples,
+		CpuUsage:        a.values[0].aggregate(),
+		Load1:           a.values[1].aggregate(),
+		MemoryUsed:      a.values[2].aggregate(),
+		MemoryAvailable: a.values[3].aggregate(),
+		DiskFree:        a.values[4].aggregate(),
+		TaskCount:       a.values[5].aggregate(),
+	}
+}
@@ -0,0 +1,92 @@
+package stats
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	memTotalDesc = prometheus.NewDesc("cube_node_memory_total_bytes",
+		"Total memory of the node.", []string{"node"}, nil)
+	memAvailableDesc = prometheus.NewDesc("cube_node_memory_available_bytes",
+		"Memory available for new tasks on the node.", []string{"node"}, nil)
+	diskTotalDesc = prometheus.NewDesc("cube_node_disk_total_bytes",
+		"Size of the node's root filesystem.", []string{"node"}, nil)
+	diskFreeDesc = prometheus.NewDesc("cube_node_disk_free_bytes",
+		"Free space on the node's root filesystem.", []string{"node"}, nil)
+	cpusDesc = prometheus.NewDesc("cube_node_cpus",
+		"Number of cpus of the node.", []string{"node"}, nil)
+	cpuUsageDesc = prometheus.NewDesc("cube_node_cpu_usage_ratio",
+		"Share of cpu time the node was busy, from 0 to 1.", []string{"node"}, nil)
+	loadDesc = prometheus.NewDesc("cube_node_load",
+		"Load average of the node.", []string{"node", "period"}, nil)
+	tasksDesc = prometheus.NewDesc("cube_node_tasks",
+		"Number of tasks the node runs.", []string{"node"}, nil)
+	netRxDesc = prometheus.NewDesc("cube_node_network_receive_bytes_total",
+		"Bytes received by a network interface of the node.", []string{"node", "device"}, nil)
+	netTxDesc = prometheus.NewDesc("cube_node_network_transmit_bytes_total",
+		"Bytes sent by a network interface of the node.", []string{"node", "device"}, nil)
+	diskReadDesc = prometheus.NewDesc("cube_node_disk_read_bytes_total",
+		"Bytes read from a block device of the node.", []string{"node", "device"}, nil)
+	diskWriteDesc = prometheus.NewDesc("cube_node_disk_written_bytes_total",
+		"Bytes written to a block device of the node.", []string{"node", "device"}, nil)
+)
+
+// Collector exports the host stats of nodes as prometheus metrics labelled
+// with the node name. The stats are fetched on every scrape.
+type Collector struct {
+	stats func() map[string]*Stats
+}
+
+func NewCollector(stats func() map[string]*Stats) *Collector {
+	return &Collector{stats: stats}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		memTotalDesc, memAvailableDesc, diskTotalDesc, diskFreeDesc, cpusDesc,
+		cpuUsageDesc, loadDesc, tasksDesc, netRxDesc, netTxDesc, diskReadDesc, diskWriteDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+
+	for node, s := range c.stats() {
+		if s == nil {
+			continue
+		}
+		gauge(cpusDesc, float64(s.CpuCount), node)
+		gauge(tasksDesc, float64(s.TaskCount), node)
+		if s.MemStats != nil {
+			gauge(memTotalDesc, float64(s.MemStats.Total), node)
+			gauge(memAvailableDesc, float64(s.MemStats.Available), node)
+		}
+		if s.DiskStats != nil {
+			gauge(diskTotalDesc, float64(s.DiskStats.Total), node)
+			gauge(diskFreeDesc, float64(s.DiskStats.Free), node)
+		}
+		if s.CpuStats != nil {
+			gauge(cpuUsageDesc, s.CpuStats.Usage, node)
+		}
+		if s.LoadStats != nil {
+			for i, period := range []string{"1m", "5m", "15m"} {
+				if i < len(s.LoadStats.Avg) {
+					gauge(loadDesc, s.LoadStats.Avg[i], node, period)
+				}
+			}
+		}
+		for _, n := range s.NetStats {
+			counter(netRxDesc, n.RxBytes, node, n.Name)
+			counter(netTxDesc, n.TxBytes, node, n.Name)
+		}
+		for _, d := range s.DiskIOStats {
+			counter(diskReadDesc, d.ReadBytes, node, d.Name)
+			counter(diskWriteDesc, d.WriteBytes, node, d.Name)
+		}
+	}
+}
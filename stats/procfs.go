@@ -0,0 +1,218 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+// DiskIOStats are the cumulative io counters of a block device, as listed
+// in /proc/diskstats.
+type DiskIOStats struct {
+	Name         string
+	ReadsTotal   uint64
+	ReadBytes    uint64
+	WritesTotal  uint64
+	WriteBytes   uint64
+	IoTimeMillis uint64
+}
+
+// NetStats are the cumulative counters of a network interface, as listed
+// in /proc/net/dev.
+type NetStats struct {
+	Name      string
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+// diskSectorSize is the unit of the sector counts in /proc/diskstats,
+// regardless of the device's actual sector size.
+const diskSectorSize = 512
+
+// ProcFS reads host stats from a procfs mount. Root defaults to /proc and
+// can point at a fixture directory in tests.
+type ProcFS struct {
+	Root string
+}
+
+func (p ProcFS) path(name string) string {
+	root := p.Root
+	if root == "" {
+		root = "/proc"
+	}
+	return filepath.Join(root, name)
+}
+
+// readFields calls fn with the whitespace separated fields of each line of
+// a procfs file.
+func (p ProcFS) readFields(name string, fn func(fields []string) error) error {
+	f, err := os.Open(p.path(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := fn(strings.Fields(scanner.Text())); err != nil {
+			return fmt.Errorf("parsing %s: %w", p.path(name), err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseUints parses fields as unsigned integers.
+func parseUints(fields []string) ([]uint64, error) {
+	values := make([]uint64, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", field)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// LoadAvg reads the 1, 5 and 15 minute load averages from /proc/loadavg.
+func (p ProcFS) LoadAvg() (*LoadStats, error) {
+	var loadavg []float64
+	err := p.readFields("loadavg", func(fields []string) error {
+		if len(fields) < 3 {
+			return fmt.Errorf("expected 3 load averages, got %v", fields)
+		}
+		for _, field := range fields[:3] {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return err
+			}
+			loadavg = append(loadavg, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if loadavg == nil {
+		return nil, fmt.Errorf("%s is empty", p.path("loadavg"))
+	}
+	return &LoadStats{Avg: loadavg}, nil
+}
+
+// MemInfo reads memory usage from /proc/meminfo.
+func (p ProcFS) MemInfo() (*mem.VirtualMemoryStat, error) {
+	values := map[string]uint64{}
+	err := p.readFields("meminfo", func(fields []string) error {
+		if len(fields) < 2 {
+			return nil
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q", fields[0], fields[1])
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total, ok := values["MemTotal"]
+	if !ok || total == 0 {
+		return nil, fmt.Errorf("no MemTotal in %s", p.path("meminfo"))
+	}
+	m := mem.VirtualMemoryStat{
+		Total:   total,
+		Free:    values["MemFree"],
+		Buffers: values["Buffers"],
+		Cached:  values["Cached"] + values["SReclaimable"],
+	}
+	m.Available, ok = values["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 do not estimate available memory
+		m.Available = m.Free + m.Buffers + m.Cached
+	}
+	if used := m.Free + m.Buffers + m.Cached; used < total {
+		m.Used = total - used
+	}
+	m.UsedPercent = float64(m.Used) / float64(total) * 100
+	return &m, nil
+}
+
+// DiskIO reads the io counters of every block device from /proc/diskstats.
+func (p ProcFS) DiskIO() ([]DiskIOStats, error) {
+	var disks []DiskIOStats
+	err := p.readFields("diskstats", func(fields []string) error {
+		if len(fields) < 14 {
+			return nil
+		}
+		v, err := parseUints(fields[3:13])
+		if err != nil {
+			return err
+		}
+		disks = append(disks, DiskIOStats{
+			Name:         fields[2],
+			ReadsTotal:   v[0],
+			ReadBytes:    v[2] * diskSectorSize,
+			WritesTotal:  v[4],
+			WriteBytes:   v[6] * diskSectorSize,
+			IoTimeMillis: v[9],
+		})
+		return nil
+	})
+	return disks, err
+}
+
+// NetDev reads the counters of every network interface from /proc/net/dev.
+func (p ProcFS) NetDev() ([]NetStats, error) {
+	var ifaces []NetStats
+	f, err := os.Open(p.path("net/dev"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The interface name is followed by a colon, which may not be
+		// separated from the first counter by a space.
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			continue
+		}
+		v, err := parseUints(fields[:12])
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p.path("net/dev"), err)
+		}
+		ifaces = append(ifaces, NetStats{
+			Name:      strings.TrimSpace(name),
+			RxBytes:   v[0],
+			RxPackets: v[1],
+			RxErrors:  v[2],
+			RxDropped: v[3],
+			TxBytes:   v[8],
+			TxPackets: v[9],
+			TxErrors:  v[10],
+			TxDropped: v[11],
+		})
+	}
+	return ifaces, scanner.Err()
+}
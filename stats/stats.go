@@ -3,6 +3,7 @@ package stats
 import (
 	"log"
 	"os/exec"
+	"runtime"
 	"strconv"
 	"strings"
 
@@ -10,27 +11,39 @@ import (
 	"github.com/shirou/gopsutil/mem"
 )
 
-type CpuStats struct {
-	Usage float64
-}
-
 type LoadStats struct {
 	Avg []float64
 }
 
 type Stats struct {
-	MemStats  *mem.VirtualMemoryStat
-	DiskStats *disk.UsageStat
-	CpuStats  *CpuStats
-	LoadStats *LoadStats
-	TaskCount int
+	MemStats    *mem.VirtualMemoryStat
+	DiskStats   *disk.UsageStat
+	CpuStats    *CpuStats
+	LoadStats   *LoadStats
+	DiskIOStats []DiskIOStats
+	NetStats    []NetStats
+	CpuCount    int
+	TaskCount   int
+}
+
+// procfs is where host stats are read from on Linux.
+var procfs = ProcFS{}
+
+// SetProcFS changes where host stats are read from on Linux, e.g. to the
+// host's /proc mounted into the container of the worker. It is meant to be
+// called before stats are collected.
+func SetProcFS(p ProcFS) {
+	procfs = p
 }
 
 func GetStats() *Stats {
 	return &Stats{
-		MemStats: GetMemoryInfo(),
-		DiskStats: GetDiskInfo(),
-		LoadStats: GetLoadAvg(),
+		MemStats:    GetMemoryInfo(),
+		DiskStats:   GetDiskInfo(),
+		LoadStats:   GetLoadAvg(),
+		DiskIOStats: GetDiskIOInfo(),
+		NetStats:    GetNetInfo(),
+		CpuCount:    runtime.NumCPU(),
 	}
 }
 
@@ -46,9 +59,15 @@ func (s *Stats) DiskFree() uint64  { return s.DiskStats.Free }
 func (s *Stats) DiskUsed() uint64  { return s.DiskStats.Used }
 
 func GetMemoryInfo() *mem.VirtualMemoryStat {
-	memstats, err := mem.VirtualMemory()
+	var memstats *mem.VirtualMemoryStat
+	var err error
+	if runtime.GOOS == "linux" {
+		memstats, err = procfs.MemInfo()
+	} else {
+		memstats, err = mem.VirtualMemory()
+	}
 	if err != nil {
-		log.Printf("Error reading from /proc/meminfo")
+		log.Printf("Error reading memory info: %v\n", err)
 		return &mem.VirtualMemoryStat{}
 	}
 	return memstats
@@ -63,27 +82,49 @@ func GetDiskInfo() *disk.UsageStat {
 	return diskstats
 }
 
-// GetCpuInfo See https://godoc.org/github.com/c9s/goprocinfo/linux#CPUStat
-// func GetCpuStats() *cpu {
-// 	stats, err := linux.ReadStat("/proc/stat")
-// 	if err != nil {
-// 		log.Printf("Error reading from /proc/stat")
-// 		return &linux.CPUStat{}
-// 	}
-// 	return &stats.CPUStatAll
-// }
-
-// GetLoadAvg See https://godoc.org/github.com/c9s/goprocinfo/linux#LoadAvg
+// GetDiskIOInfo returns the io counters of block devices, on Linux only.
+func GetDiskIOInfo() []DiskIOStats {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	disks, err := procfs.DiskIO()
+	if err != nil {
+		log.Printf("Error reading disk io stats: %v\n", err)
+	}
+	return disks
+}
+
+// GetNetInfo returns the counters of network interfaces, on Linux only.
+func GetNetInfo() []NetStats {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	ifaces, err := procfs.NetDev()
+	if err != nil {
+		log.Printf("Error reading network stats: %v\n", err)
+	}
+	return ifaces
+}
+
 func GetLoadAvg() *LoadStats {
 	loadavg, err := GetLoadStats()
 	if err != nil {
-		log.Printf("Error getting load")
+		log.Printf("Error getting load: %v\n", err)
 		return &LoadStats{}
 	}
 	return loadavg
 }
 
+// GetLoadStats reads /proc/loadavg on Linux and asks sysctl elsewhere.
 func GetLoadStats() (*LoadStats, error) {
+	if runtime.GOOS == "linux" {
+		return procfs.LoadAvg()
+	}
+	return sysctlLoadStats()
+}
+
+// sysctlLoadStats reads the load average on macOS and the BSDs.
+func sysctlLoadStats() (*LoadStats, error) {
 	cmd := exec.Command("sysctl", "-n", "vm.loadavg")
 	output, err := cmd.Output()
 	if err != nil {
@@ -2,7 +2,10 @@ package stats
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/mem"
@@ -50,3 +53,142 @@ func TestLoad(t *testing.T) {
 	}
 	fmt.Printf("LoadStats: %v", loadStats)
 }
+
+func TestCpuSampler(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "stat")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing stat file: %v\n", err)
+		}
+	}
+
+	sampler := CpuSampler{ProcFS: ProcFS{Root: root}}
+	write("cpu  100 0 100 700 100 0 0 0 0 0\n" +
+		"cpu0 50 0 50 350 50 0 0 0 0 0\n" +
+		"cpu1 50 0 50 350 50 0 0 0 0 0\n" +
+		"intr 12345\n")
+	first, err := sampler.Sample()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if len(first.Cores) != 2 || first.Usage < 0.19 || first.Usage > 0.21 {
+		t.Fatalf("Unexpected usage since boot: %+v", first)
+	}
+
+	// cpu0 is fully busy in user space, cpu1 waits on io
+	write("cpu  200 0 100 700 200 0 0 0 0 0\n" +
+		"cpu0 150 0 50 350 50 0 0 0 0 0\n" +
+		"cpu1 50 0 50 350 150 0 0 0 0 0\n")
+	second, err := sampler.Sample()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if second.Usage != 0.5 || second.User != 0.5 || second.Iowait != 0.5 {
+		t.Fatalf("Unexpected total usage: %+v", second.CpuUsage)
+	}
+	if second.Cores[0].Usage != 1 || second.Cores[1].Iowait != 1 {
+		t.Fatalf("Unexpected per-core usage: %+v", second.Cores)
+	}
+}
+
+func TestCpuSamplerSharedProcFS(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "stat"), []byte("cpu  100 0 100 700 100 0 0 0 0 0\n"), 0644)
+	SetProcFS(ProcFS{Root: root})
+	defer SetProcFS(ProcFS{})
+
+	var sampler CpuSampler
+	s, err := sampler.Sample()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if s.Usage < 0.19 || s.Usage > 0.21 {
+		t.Fatalf("Expected usage from the shared procfs, got %+v", s.CpuUsage)
+	}
+}
+
+func TestProcFS(t *testing.T) {
+	p := ProcFS{Root: "testdata/proc"}
+
+	load, err := p.LoadAvg()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if len(load.Avg) != 3 || load.Avg[0] != 0.52 || load.Avg[2] != 0.59 {
+		t.Fatalf("Unexpected load average: %v", load.Avg)
+	}
+
+	m, err := p.MemInfo()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if m.Total != 8000000*1024 || m.Available != 5000000*1024 ||
+		m.Cached != 1500000*1024 || m.Used != 4000000*1024 || m.UsedPercent != 50 {
+		t.Fatalf("Unexpected memory info: %v", m)
+	}
+
+	disks, err := p.DiskIO()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if len(disks) != 3 || disks[1].Name != "sda" || disks[1].ReadsTotal != 12000 ||
+		disks[1].ReadBytes != 960000*512 || disks[1].WriteBytes != 640000*512 ||
+		disks[1].IoTimeMillis != 11000 {
+		t.Fatalf("Unexpected disk stats: %+v", disks)
+	}
+
+	ifaces, err := p.NetDev()
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	if len(ifaces) != 2 || ifaces[1].Name != "eth0" || ifaces[1].RxBytes != 98765432 ||
+		ifaces[1].RxDropped != 7 || ifaces[1].TxBytes != 12345678 || ifaces[1].TxDropped != 2 {
+		t.Fatalf("Unexpected network stats: %+v", ifaces)
+	}
+
+	if _, err := (ProcFS{Root: "testdata/missing"}).LoadAvg(); err == nil {
+		t.Fatalf("Expected an error for a missing procfs")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	for _, resolution := range []time.Duration{0, -time.Second, 2 * time.Minute} {
+		if _, err := NewHistory(resolution, time.Minute); err == nil {
+			t.Fatalf("Expected resolution %v to be rejected", resolution)
+		}
+	}
+	h, err := NewHistory(10*time.Second, time.Minute)
+	if err != nil {
+		t.Fatalf("Error: %v\n", err)
+	}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 9; i++ {
+		h.Add(start.Add(time.Duration(i)*10*time.Second), &Stats{
+			CpuStats:  &CpuStats{CpuUsage: CpuUsage{Usage: float64(i) / 10}},
+			TaskCount: i,
+		})
+	}
+
+	// The buffer holds a minute of samples, so the first three are gone
+	samples := h.Range(start, start.Add(time.Hour))
+	if len(samples) != 6 || !samples[0].Time.Equal(start.Add(30*time.Second)) {
+		t.Fatalf("Unexpected samples: %v", samples)
+	}
+
+	points := h.Downsample(start, start.Add(time.Hour), 30*time.Second)
+	if len(points) != 2 || points[0].Samples != 3 || !points[1].Time.Equal(start.Add(time.Minute)) {
+		t.Fatalf("Unexpected points: %+v", points)
+	}
+	tasks := points[0].TaskCount
+	if tasks.Min != 3 || tasks.Max != 5 || tasks.Avg != 4 {
+		t.Fatalf("Unexpected task count aggregate: %+v", tasks)
+	}
+	if points[1].CpuUsage.Max != 0.8 || points[0].MemoryUsed != nil {
+		t.Fatalf("Unexpected point: %+v", points[1])
+	}
+
+	if points := h.Downsample(start.Add(45*time.Second), start.Add(65*time.Second), 0); len(points) != 2 {
+		t.Fatalf("Expected a point per sample, got %+v", points)
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore keeps JSON encoded values in a single bucket of an on-disk
+// bolt database.
+type BoltStore[T any] struct {
+	Db     *bolt.DB
+	Bucket string
+}
+
+func NewBoltStore[T any](file string, mode os.FileMode, bucket string) (*BoltStore[T], error) {
+	db, err := bolt.Open(file, mode, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %v: %w", file, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create bucket %v: %w", bucket, err)
+	}
+
+	return &BoltStore[T]{Db: db, Bucket: bucket}, nil
+}
+
+func (s *BoltStore[T]) Close() error {
+	return s.Db.Close()
+}
+
+func (s *BoltStore[T]) Put(key string, value T) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("unable to marshal value for %v: %w", key, err)
+	}
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(s.Bucket)).Put([]byte(key), buf)
+	})
+}
+
+func (s *BoltStore[T]) Get(key string) (T, error) {
+	var value T
+	err := s.Db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte(s.Bucket)).Get([]byte(key))
+		if buf == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return json.Unmarshal(buf, &value)
+	})
+	return value, err
+}
+
+func (s *BoltStore[T]) List() ([]T, error) {
+	values := []T{}
+	err := s.Db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(s.Bucket)).ForEach(func(k, v []byte) error {
+			var value T
+			if err := json.Unmarshal(v, &value); err != nil {
+				return fmt.Errorf("unable to unmarshal value for %s: %w", k, err)
+			}
+			values = append(values, value)
+			return nil
+		})
+	})
+	return values, err
+}
+
+func (s *BoltStore[T]) Count() (int, error) {
+	count := 0
+	err := s.Db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket([]byte(s.Bucket)).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+func (s *BoltStore[T]) Delete(key string) error {
+	return s.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(s.Bucket)).Delete([]byte(key))
+	})
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// InMemoryStore keeps values JSON encoded, like BoltStore does, so that
+// callers always get their own copy and cannot race on stored values.
+type InMemoryStore[T any] struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewInMemoryStore[T any]() *InMemoryStore[T] {
+	return &InMemoryStore[T]{data: make(map[string][]byte)}
+}
+
+func (s *InMemoryStore[T]) Put(key string, value T) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("unable to marshal value for %v: %w", key, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = buf
+	return nil
+}
+
+func (s *InMemoryStore[T]) Get(key string) (T, error) {
+	s.mu.RLock()
+	buf, ok := s.data[key]
+	s.mu.RUnlock()
+
+	var value T
+	if !ok {
+		return value, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	err := json.Unmarshal(buf, &value)
+	return value, err
+}
+
+func (s *InMemoryStore[T]) List() ([]T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := make([]T, 0, len(s.data))
+	for key, buf := range s.data {
+		var value T
+		err := json.Unmarshal(buf, &value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unmarshal value for %s: %w", key, err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (s *InMemoryStore[T]) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data), nil
+}
+
+func (s *InMemoryStore[T]) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
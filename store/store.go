@@ -0,0 +1,33 @@
+package store
+
+import "errors"
+
+var ErrNotFound = errors.New("key not found")
+
+// Store is a key-value store for values of type T. Get returns an error
+// wrapping ErrNotFound when there is no value for the key.
+type Store[T any] interface {
+	Put(key string, value T) error
+	Get(key string) (T, error)
+	List() ([]T, error)
+	Count() (int, error)
+	Delete(key string) error
+}
+
+const (
+	MemoryType     = "memory"
+	PersistentType = "persistent"
+)
+
+// New creates a store of the given type. Persistent stores keep their data
+// in the bucket of the bolt database at path.
+func New[T any](dbType string, path string, bucket string) (Store[T], error) {
+	switch dbType {
+	case "", MemoryType:
+		return NewInMemoryStore[T](), nil
+	case PersistentType:
+		return NewBoltStore[T](path, 0600, bucket)
+	default:
+		return nil, errors.New("unknown store type " + dbType)
+	}
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type item struct {
+	Name  string
+	Count int
+}
+
+func testStore(test *testing.T, s Store[*item]) {
+	err := s.Put("a", &item{Name: "a", Count: 1})
+	if err != nil {
+		test.Fatalf("Error putting item: %v", err)
+	}
+	s.Put("b", &item{Name: "b", Count: 2})
+	s.Put("a", &item{Name: "a", Count: 3})
+
+	a, err := s.Get("a")
+	if err != nil {
+		test.Fatalf("Error getting item: %v", err)
+	}
+	if a.Count != 3 {
+		test.Fatalf("Expected overwritten item, got %v", a)
+	}
+
+	_, err = s.Get("missing")
+	if !errors.Is(err, ErrNotFound) {
+		test.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	count, _ := s.Count()
+	if count != 2 {
+		test.Fatalf("Expected 2 items, got %d", count)
+	}
+
+	items, err := s.List()
+	if err != nil {
+		test.Fatalf("Error listing items: %v", err)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	if len(items) != 2 || items[0].Name != "a" || items[1].Name != "b" {
+		test.Fatalf("Unexpected items: %v", items)
+	}
+
+	err = s.Delete("a")
+	if err != nil {
+		test.Fatalf("Error deleting item: %v", err)
+	}
+	if _, err = s.Get("a"); !errors.Is(err, ErrNotFound) {
+		test.Fatalf("Expected deleted item to be gone, got %v", err)
+	}
+}
+
+func TestInMemoryStore(test *testing.T) {
+	testStore(test, NewInMemoryStore[*item]())
+}
+
+func TestBoltStore(test *testing.T) {
+	file := filepath.Join(test.TempDir(), "items.db")
+	s, err := NewBoltStore[*item](file, 0600, "items")
+	if err != nil {
+		test.Fatalf("Error creating store: %v", err)
+	}
+	testStore(test, s)
+	s.Close()
+
+	reopened, err := NewBoltStore[*item](file, 0600, "items")
+	if err != nil {
+		test.Fatalf("Error reopening store: %v", err)
+	}
+	defer reopened.Close()
+	b, err := reopened.Get("b")
+	if err != nil || b.Count != 2 {
+		test.Fatalf("Expected item to survive reopening, got %v, %v", b, err)
+	}
+}
@@ -0,0 +1,360 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/moby/moby/pkg/stdcopy"
+)
+
+// Docker is the Runtime backed by a Docker daemon.
+type Docker struct {
+	Client *client.Client
+}
+
+func NewDocker() (*Docker, error) {
+	dc, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create docker client: %w", err)
+	}
+	return &Docker{Client: dc}, nil
+}
+
+func (d *Docker) Pull(ctx context.Context, ref string, opts PullOptions) error {
+	pullOpts := image.PullOptions{}
+	if opts.Auth != nil {
+		auth, err := registry.EncodeAuthConfig(registry.AuthConfig{
+			Username:      opts.Auth.Username,
+			Password:      opts.Auth.Password,
+			IdentityToken: opts.Auth.IdentityToken,
+			ServerAddress: opts.Auth.ServerAddress,
+		})
+		if err != nil {
+			return err
+		}
+		pullOpts.RegistryAuth = auth
+	}
+	reader, err := d.Client.ImagePull(ctx, ref, pullOpts)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// The pull reports its progress, and failures, as a stream of json
+	// messages.
+	dec := json.NewDecoder(reader)
+	for {
+		var msg struct {
+			ID          string `json:"id"`
+			Status      string `json:"status"`
+			ErrorDetail *struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.ErrorDetail != nil {
+			return fmt.Errorf("pulling %s: %s", ref, msg.ErrorDetail.Message)
+		}
+		if opts.Progress != nil {
+			opts.Progress(PullProgress{ID: msg.ID, Status: msg.Status})
+		}
+	}
+}
+
+func (d *Docker) ImageExists(ctx context.Context, ref string) (bool, error) {
+	_, _, err := d.Client.ImageInspectWithRaw(ctx, ref)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Docker) ListImages(ctx context.Context) ([]ImageInfo, error) {
+	summaries, err := d.Client.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageInfo
+	for _, s := range summaries {
+		images = append(images, ImageInfo{
+			ID:          s.ID,
+			Tags:        s.RepoTags,
+			RepoDigests: s.RepoDigests,
+			Size:        s.Size,
+			Created:     time.Unix(s.Created, 0).UTC(),
+		})
+	}
+	return images, nil
+}
+
+func (d *Docker) RemoveImage(ctx context.Context, ref string) error {
+	_, err := d.Client.ImageRemove(ctx, ref, image.RemoveOptions{PruneChildren: true})
+	return err
+}
+
+func (d *Docker) Create(ctx context.Context, c *Config) (string, error) {
+	r := container.Resources{
+		Memory:   c.Memory,
+		NanoCPUs: int64(c.Cpu * math.Pow(10, 9)),
+	}
+
+	cc := container.Config{
+		Image:        c.Image,
+		Tty:          false,
+		AttachStdin:  c.AttachStdin,
+		AttachStdout: c.AttachStdout,
+		AttachStderr: c.AttachStderr,
+		Entrypoint:   c.Entrypoint,
+		Cmd:          c.Cmd,
+		WorkingDir:   c.WorkingDir,
+		Env:          c.Env,
+		ExposedPorts: c.ExposedPorts,
+	}
+
+	hc := container.HostConfig{
+		Resources:    r,
+		PortBindings: c.PortBindings,
+		Mounts:       mounts(c.Mounts),
+	}
+
+	resp, err := d.Client.ContainerCreate(ctx, &cc, &hc, nil, nil, c.Name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func mounts(ms []Mount) []mount.Mount {
+	var result []mount.Mount
+	for _, m := range ms {
+		dm := mount.Mount{
+			Type:     mount.Type(m.GetType()),
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+		if m.GetType() == TmpfsMount && m.SizeBytes > 0 {
+			dm.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: m.SizeBytes}
+		}
+		result = append(result, dm)
+	}
+	return result
+}
+
+func (d *Docker) Start(ctx context.Context, containerID string) error {
+	return wrapNotFound(d.Client.ContainerStart(ctx, containerID, container.StartOptions{}))
+}
+
+func (d *Docker) Stop(ctx context.Context, containerID string) error {
+	return wrapNotFound(d.Client.ContainerStop(ctx, containerID, container.StopOptions{}))
+}
+
+func (d *Docker) Remove(ctx context.Context, containerID string) error {
+	// Only anonymous volumes go with the container, the worker removes
+	// named ones according to their retention.
+	err := d.Client.ContainerRemove(ctx, containerID, container.RemoveOptions{
+		RemoveVolumes: true,
+		RemoveLinks:   false,
+		Force:         false,
+	})
+	return wrapNotFound(err)
+}
+
+func (d *Docker) CreateVolume(ctx context.Context, name string) error {
+	_, err := d.Client.VolumeCreate(ctx, volume.CreateOptions{Name: name})
+	return err
+}
+
+func (d *Docker) RemoveVolume(ctx context.Context, name string) error {
+	return d.Client.VolumeRemove(ctx, name, false)
+}
+
+func (d *Docker) Inspect(ctx context.Context, containerID string) (*ContainerInfo, error) {
+	resp, err := d.Client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, wrapNotFound(err)
+	}
+
+	info := ContainerInfo{
+		ID:    resp.ID,
+		Name:  strings.TrimPrefix(resp.Name, "/"),
+		Image: resp.Config.Image,
+	}
+	if resp.State != nil {
+		info.Running = resp.State.Running
+		info.ExitCode = resp.State.ExitCode
+		info.OOMKilled = resp.State.OOMKilled
+		info.StartedAt, _ = time.Parse(time.RFC3339Nano, resp.State.StartedAt)
+		info.FinishedAt, _ = time.Parse(time.RFC3339Nano, resp.State.FinishedAt)
+	}
+	if resp.NetworkSettings != nil {
+		info.Ports = resp.NetworkSettings.Ports
+	}
+	return &info, nil
+}
+
+func (d *Docker) DiskUsage(ctx context.Context, containerID string) (int64, error) {
+	resp, _, err := d.Client.ContainerInspectWithRaw(ctx, containerID, true)
+	if err != nil {
+		return 0, wrapNotFound(err)
+	}
+	if resp.SizeRw == nil {
+		return 0, fmt.Errorf("no size reported for container %s", containerID)
+	}
+	return *resp.SizeRw, nil
+}
+
+func (d *Docker) Logs(ctx context.Context, containerID string, opts LogsOptions, stdout, stderr io.Writer) error {
+	out, err := d.Client.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Tail:       opts.Tail,
+		Since:      opts.Since,
+		Timestamps: opts.Timestamps,
+	})
+	if err != nil {
+		return wrapNotFound(err)
+	}
+	defer out.Close()
+	_, err = stdcopy.StdCopy(stdout, stderr, out)
+	return err
+}
+
+func (d *Docker) Stats(ctx context.Context, containerID string) (*ContainerStats, error) {
+	resp, err := d.Client.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return nil, wrapNotFound(err)
+	}
+	defer resp.Body.Close()
+
+	var s container.StatsResponse
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode stats for %s: %w", containerID, err)
+	}
+
+	cs := ContainerStats{
+		Time:        s.Read,
+		MemoryUsage: s.MemoryStats.Usage,
+		MemoryLimit: s.MemoryStats.Limit,
+	}
+
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		cs.CpuPercent = cpuDelta / systemDelta * float64(s.CPUStats.OnlineCPUs) * 100
+	}
+
+	// Like `docker stats`, do not count the page cache as used memory.
+	if cache, ok := s.MemoryStats.Stats["inactive_file"]; ok && cache < cs.MemoryUsage {
+		cs.MemoryUsage -= cache
+	} else if cache, ok := s.MemoryStats.Stats["total_inactive_file"]; ok && cache < cs.MemoryUsage {
+		cs.MemoryUsage -= cache
+	}
+
+	for _, n := range s.Networks {
+		cs.NetworkRxBytes += n.RxBytes
+		cs.NetworkTxBytes += n.TxBytes
+	}
+
+	for _, e := range s.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			cs.BlockReadBytes += e.Value
+		case "write":
+			cs.BlockWriteBytes += e.Value
+		}
+	}
+
+	return &cs, nil
+}
+
+func (d *Docker) Exec(ctx context.Context, containerID string, cmd []string) (*ExecResult, error) {
+	exec, err := d.Client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, wrapNotFound(err)
+	}
+
+	resp, err := d.Client.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, resp.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	inspect, err := d.Client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecResult{
+		ExitCode: inspect.ExitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}, nil
+}
+
+func (d *Docker) ExecStream(ctx context.Context, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	exec, err := d.Client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, wrapNotFound(err)
+	}
+
+	resp, err := d.Client.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Close()
+
+	go func() {
+		io.Copy(resp.Conn, stdin)
+		resp.CloseWrite()
+	}()
+	_, err = stdcopy.StdCopy(stdout, stderr, resp.Reader)
+	if err != nil {
+		return 0, err
+	}
+
+	inspect, err := d.Client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return 0, err
+	}
+	return inspect.ExitCode, nil
+}
+
+func wrapNotFound(err error) error {
+	if err != nil && client.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %v", ErrContainerNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,469 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// FakeRuntime is an in-memory Runtime for tests. Containers get the
+// deterministic ids "fake-1", "fake-2", ... and never run anything.
+type FakeRuntime struct {
+	mu         sync.Mutex
+	nextID     int
+	nextPort   int
+	Images     map[string]bool
+	Containers map[string]*FakeContainer
+	Volumes    map[string]bool
+	// Pulls counts how often each image was pulled
+	Pulls map[string]int
+	// ImageSizes are the sizes ListImages reports, by image
+	ImageSizes map[string]int64
+	// Credentials makes pulling the image fail unless the given
+	// credentials are used.
+	Credentials map[string]RegistryAuth
+	// Errors makes the named operation ("pull", "create", "start", "stop",
+	// "remove", "inspect", "logs", "stats", "exec", "disk_usage",
+	// "create_volume", "remove_volume", "list_images", "remove_image") fail
+	// with the given error.
+	Errors map[string]error
+	// ExecHandler answers Exec calls; by default commands exit with 0.
+	ExecHandler func(containerID string, cmd []string) ExecResult
+	// ExecStreamHandler answers ExecStream calls; by default commands echo
+	// their input to stdout, like cat, and exit with 0.
+	ExecStreamHandler func(containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) int
+	// PullHook is called before an image is pulled, e.g. to make it slow.
+	PullHook func(image string)
+}
+
+type FakeContainer struct {
+	Info   ContainerInfo
+	Config Config
+	Stdout string
+	Stderr string
+	Stats  ContainerStats
+	// DiskUsage is the size of the writable layer in bytes
+	DiskUsage int64
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		nextPort:    32768,
+		Images:      make(map[string]bool),
+		Containers:  make(map[string]*FakeContainer),
+		Volumes:     make(map[string]bool),
+		Pulls:       make(map[string]int),
+		ImageSizes:  make(map[string]int64),
+		Credentials: make(map[string]RegistryAuth),
+		Errors:      make(map[string]error),
+	}
+}
+
+func (f *FakeRuntime) Pull(ctx context.Context, image string, opts PullOptions) error {
+	f.mu.Lock()
+	hook := f.PullHook
+	f.mu.Unlock()
+	if hook != nil {
+		hook(image)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors["pull"]; err != nil {
+		return err
+	}
+	if auth, ok := f.Credentials[image]; ok && (opts.Auth == nil || *opts.Auth != auth) {
+		return fmt.Errorf("pulling %s: unauthorized", image)
+	}
+	if opts.Progress != nil {
+		opts.Progress(PullProgress{Status: "Pulling from " + image})
+		opts.Progress(PullProgress{ID: "layer", Status: "Pull complete"})
+	}
+	f.Images[image] = true
+	f.Pulls[image]++
+	return nil
+}
+
+func (f *FakeRuntime) ImageExists(ctx context.Context, image string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Images[image], nil
+}
+
+// ListImages reports each image as tagged with the reference it was
+// pulled by, or with it as digest when it is pinned to one, and with the
+// id "sha256:" followed by that reference.
+func (f *FakeRuntime) ListImages(ctx context.Context) ([]ImageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors["list_images"]; err != nil {
+		return nil, err
+	}
+	var images []ImageInfo
+	for ref := range f.Images {
+		if !f.Images[ref] {
+			continue
+		}
+		img := ImageInfo{ID: "sha256:" + ref, Size: f.ImageSizes[ref]}
+		if strings.Contains(ref, "@") {
+			img.RepoDigests = []string{ref}
+		} else {
+			img.Tags = []string{ref}
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+func (f *FakeRuntime) RemoveImage(ctx context.Context, image string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors["remove_image"]; err != nil {
+		return err
+	}
+	ref := strings.TrimPrefix(image, "sha256:")
+	if !f.Images[ref] {
+		return fmt.Errorf("no such image: %s", image)
+	}
+	for _, fc := range f.Containers {
+		if fc.Config.Image == ref {
+			return fmt.Errorf("image %s is being used by container %s", image, fc.Info.ID)
+		}
+	}
+	delete(f.Images, ref)
+	return nil
+}
+
+func (f *FakeRuntime) Create(ctx context.Context, c *Config) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors["create"]; err != nil {
+		return "", err
+	}
+	if !f.Images[c.Image] {
+		return "", fmt.Errorf("no such image: %s", c.Image)
+	}
+	for _, fc := range f.Containers {
+		if c.Name != "" && fc.Info.Name == c.Name {
+			return "", fmt.Errorf("container name %q is already in use", c.Name)
+		}
+	}
+
+	for _, m := range c.Mounts {
+		if m.GetType() == VolumeMount {
+			// Like docker, create volumes that do not exist yet.
+			f.Volumes[m.Source] = true
+		}
+	}
+
+	ports := nat.PortMap{}
+	for p := range c.ExposedPorts {
+		if bindings, ok := c.PortBindings[p]; ok {
+			for _, b := range bindings {
+				if f.published(b.HostPort, p.Proto()) {
+					return "", fmt.Errorf("port %s/%s is already allocated", b.HostPort, p.Proto())
+				}
+				ports[p] = append(ports[p], nat.PortBinding{HostIP: "0.0.0.0", HostPort: b.HostPort})
+			}
+			continue
+		}
+		ports[p] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: strconv.Itoa(f.nextPort)}}
+		f.nextPort++
+	}
+
+	f.nextID++
+	id := fmt.Sprintf("fake-%d", f.nextID)
+	f.Containers[id] = &FakeContainer{
+		Info:   ContainerInfo{ID: id, Name: c.Name, Image: c.Image, Ports: ports},
+		Config: *c,
+	}
+	return id, nil
+}
+
+// published tells whether a running container publishes a port on the
+// host port.
+func (f *FakeRuntime) published(hostPort string, proto string) bool {
+	for _, fc := range f.Containers {
+		if !fc.Info.Running {
+			continue
+		}
+		for p, bindings := range fc.Info.Ports {
+			for _, b := range bindings {
+				if b.HostPort == hostPort && p.Proto() == proto {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (f *FakeRuntime) Start(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("start", containerID)
+	if err != nil {
+		return err
+	}
+	fc.Info.Running = true
+	fc.Info.ExitCode = 0
+	fc.Info.StartedAt = time.Now().UTC()
+	return nil
+}
+
+func (f *FakeRuntime) Stop(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("stop", containerID)
+	if err != nil {
+		return err
+	}
+	if fc.Info.Running {
+		fc.Info.Running = false
+		fc.Info.FinishedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (f *FakeRuntime) Remove(ctx context.Context, containerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("remove", containerID)
+	if err != nil {
+		return err
+	}
+	if fc.Info.Running {
+		return fmt.Errorf("cannot remove running container %s", fc.Info.ID)
+	}
+	delete(f.Containers, fc.Info.ID)
+	return nil
+}
+
+func (f *FakeRuntime) Inspect(ctx context.Context, containerID string) (*ContainerInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("inspect", containerID)
+	if err != nil {
+		return nil, err
+	}
+	info := fc.Info
+	return &info, nil
+}
+
+func (f *FakeRuntime) Logs(ctx context.Context, containerID string, opts LogsOptions, stdout, stderr io.Writer) error {
+	f.mu.Lock()
+	fc, err := f.find("logs", containerID)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	out, errOut := tail(fc.Stdout, opts.Tail), tail(fc.Stderr, opts.Tail)
+	f.mu.Unlock()
+
+	if _, err := io.WriteString(stdout, out); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(stderr, errOut); err != nil {
+		return err
+	}
+	if opts.Follow {
+		// Fake containers write nothing more, so just wait for the reader.
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// tail returns the last n lines of output, or all of it for "all" or "".
+func tail(output string, n string) string {
+	lines, err := strconv.Atoi(n)
+	if err != nil {
+		return output
+	}
+	split := strings.SplitAfter(output, "\n")
+	if split[len(split)-1] == "" {
+		split = split[:len(split)-1]
+	}
+	if lines < len(split) {
+		split = split[len(split)-lines:]
+	}
+	return strings.Join(split, "")
+}
+
+func (f *FakeRuntime) Stats(ctx context.Context, containerID string) (*ContainerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("stats", containerID)
+	if err != nil {
+		return nil, err
+	}
+	s := fc.Stats
+	s.Time = time.Now().UTC()
+	return &s, nil
+}
+
+func (f *FakeRuntime) DiskUsage(ctx context.Context, containerID string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("disk_usage", containerID)
+	if err != nil {
+		return 0, err
+	}
+	return fc.DiskUsage, nil
+}
+
+func (f *FakeRuntime) Exec(ctx context.Context, containerID string, cmd []string) (*ExecResult, error) {
+	f.mu.Lock()
+	fc, err := f.find("exec", containerID)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	if !fc.Info.Running {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("container %s is not running", fc.Info.ID)
+	}
+	id, handler := fc.Info.ID, f.ExecHandler
+	f.mu.Unlock()
+
+	if handler == nil {
+		return &ExecResult{}, nil
+	}
+	result := handler(id, cmd)
+	return &result, nil
+}
+
+func (f *FakeRuntime) ExecStream(ctx context.Context, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	f.mu.Lock()
+	fc, err := f.find("exec", containerID)
+	if err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	if !fc.Info.Running {
+		f.mu.Unlock()
+		return 0, fmt.Errorf("container %s is not running", fc.Info.ID)
+	}
+	id, handler := fc.Info.ID, f.ExecStreamHandler
+	f.mu.Unlock()
+
+	if handler == nil {
+		_, err := io.Copy(stdout, stdin)
+		return 0, err
+	}
+	return handler(id, cmd, stdin, stdout, stderr), nil
+}
+
+func (f *FakeRuntime) CreateVolume(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors["create_volume"]; err != nil {
+		return err
+	}
+	f.Volumes[name] = true
+	return nil
+}
+
+func (f *FakeRuntime) RemoveVolume(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors["remove_volume"]; err != nil {
+		return err
+	}
+	if !f.Volumes[name] {
+		return fmt.Errorf("no such volume: %s", name)
+	}
+	for _, fc := range f.Containers {
+		for _, m := range fc.Config.Mounts {
+			if m.GetType() == VolumeMount && m.Source == name {
+				return fmt.Errorf("volume %s is in use by container %s", name, fc.Info.ID)
+			}
+		}
+	}
+	delete(f.Volumes, name)
+	return nil
+}
+
+// Exit simulates the container's process exiting on its own.
+func (f *FakeRuntime) Exit(containerID string, exitCode int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fc, ok := f.Containers[containerID]; ok {
+		fc.Info.Running = false
+		fc.Info.ExitCode = exitCode
+		fc.Info.FinishedAt = time.Now().UTC()
+	}
+}
+
+// OOMKill simulates the kernel killing the container's process for
+// exceeding its memory limit.
+func (f *FakeRuntime) OOMKill(containerID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fc, ok := f.Containers[containerID]; ok {
+		fc.Info.Running = false
+		fc.Info.ExitCode = 137
+		fc.Info.OOMKilled = true
+		fc.Info.FinishedAt = time.Now().UTC()
+	}
+}
+
+// SetDiskUsage sets the size of the container's writable layer.
+func (f *FakeRuntime) SetDiskUsage(containerID string, bytes int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fc, err := f.find("", containerID); err == nil {
+		fc.DiskUsage = bytes
+	}
+}
+
+// SetLogs sets the output the container wrote so far.
+func (f *FakeRuntime) SetLogs(containerID string, stdout string, stderr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fc, err := f.find("", containerID); err == nil {
+		fc.Stdout, fc.Stderr = stdout, stderr
+	}
+}
+
+// SetStats sets the resource usage the container reports.
+func (f *FakeRuntime) SetStats(containerID string, s ContainerStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fc, err := f.find("", containerID); err == nil {
+		fc.Stats = s
+	}
+}
+
+// Container returns a copy of the container with the given id or name.
+func (f *FakeRuntime) Container(containerID string) (FakeContainer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fc, err := f.find("", containerID)
+	if err != nil {
+		return FakeContainer{}, false
+	}
+	return *fc, true
+}
+
+func (f *FakeRuntime) find(op string, containerID string) (*FakeContainer, error) {
+	if err := f.Errors[op]; err != nil {
+		return nil, err
+	}
+	if fc, ok := f.Containers[containerID]; ok {
+		return fc, nil
+	}
+	for _, fc := range f.Containers {
+		if fc.Info.Name == containerID {
+			return fc, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, containerID)
+}
@@ -0,0 +1,82 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type HealthCheckType string
+
+const (
+	HTTPHealthCheck HealthCheckType = "http"
+	TCPHealthCheck  HealthCheckType = "tcp"
+	ExecHealthCheck HealthCheckType = "exec"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultFailureThreshold    = 3
+)
+
+// HealthCheck describes how the manager probes a running task.
+type HealthCheck struct {
+	// Type is one of http (default), tcp or exec
+	Type HealthCheckType
+	// Path requested by http checks, e.g. "/health"
+	Path string
+	// Port is the container port to probe, e.g. "80/tcp". The probe goes to
+	// the host port it is published on; defaults to the first published port.
+	Port string
+	// Command run inside the container by exec checks, healthy on exit code 0
+	Command          []string
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+}
+
+// validate returns the problems with the settings of the check.
+func (hc *HealthCheck) validate() []error {
+	var errs []error
+	switch hc.Type {
+	case HTTPHealthCheck, "":
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			errs = append(errs, fmt.Errorf("health check path %q does not start with /", hc.Path))
+		}
+	case TCPHealthCheck:
+	case ExecHealthCheck:
+		if len(hc.Command) == 0 || hc.Command[0] == "" {
+			errs = append(errs, fmt.Errorf("exec health check has no command"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown health check type %q", hc.Type))
+	}
+	if hc.Port != "" {
+		if _, err := parsePort(hc.Port); err != nil {
+			errs = append(errs, fmt.Errorf("health check port: %w", err))
+		}
+	}
+	return errs
+}
+
+func (hc *HealthCheck) GetInterval() time.Duration {
+	if hc.Interval <= 0 {
+		return DefaultHealthCheckInterval
+	}
+	return hc.Interval
+}
+
+func (hc *HealthCheck) GetTimeout() time.Duration {
+	if hc.Timeout <= 0 {
+		return DefaultHealthCheckTimeout
+	}
+	return hc.Timeout
+}
+
+func (hc *HealthCheck) GetFailureThreshold() int {
+	if hc.FailureThreshold <= 0 {
+		return DefaultFailureThreshold
+	}
+	return hc.FailureThreshold
+}
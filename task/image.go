@@ -0,0 +1,66 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PullPolicy tells when the worker pulls the image of a task.
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image every time the task starts
+	PullAlways PullPolicy = "Always"
+	// PullIfNotPresent only pulls images missing on the worker
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullNever never pulls, the image must already be on the worker
+	PullNever PullPolicy = "Never"
+)
+
+// DefaultRegistry is the registry of images that do not name one.
+const DefaultRegistry = "docker.io"
+
+// RegistryAuth are the credentials for an image registry.
+type RegistryAuth struct {
+	Username      string
+	Password      string
+	IdentityToken string
+	ServerAddress string
+}
+
+type PullOptions struct {
+	Auth *RegistryAuth
+	// Progress is called with each status reported while pulling
+	Progress func(PullProgress)
+}
+
+// PullProgress is a status update of a pull, e.g. "Pull complete" for the
+// layer with the given ID.
+type PullProgress struct {
+	ID     string
+	Status string
+}
+
+func (p PullProgress) String() string {
+	if p.ID == "" {
+		return p.Status
+	}
+	return fmt.Sprintf("%s: %s", p.ID, p.Status)
+}
+
+func (t *Task) GetPullPolicy() PullPolicy {
+	if t.PullPolicy == "" {
+		return PullIfNotPresent
+	}
+	return t.PullPolicy
+}
+
+// RegistryHost returns the registry an image is pulled from, like
+// "ghcr.io" for "ghcr.io/owner/app:1.0".
+func RegistryHost(image string) string {
+	host, _, ok := strings.Cut(image, "/")
+	if !ok || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return DefaultRegistry
+	}
+	return host
+}
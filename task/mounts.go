@@ -0,0 +1,102 @@
+package task
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+type MountType string
+
+const (
+	VolumeMount MountType = "volume"
+	BindMount   MountType = "bind"
+	TmpfsMount  MountType = "tmpfs"
+)
+
+// VolumeRetention tells what happens to a named volume when its task is
+// stopped.
+type VolumeRetention string
+
+const (
+	// DeleteVolume removes the volume with the task, unless other tasks
+	// still use it
+	DeleteVolume VolumeRetention = "delete"
+	// RetainVolume keeps the volume, e.g. for the next task using it
+	RetainVolume VolumeRetention = "retain"
+)
+
+// Mount describes storage mounted into the container of a task.
+type Mount struct {
+	// Type is one of volume (default), bind or tmpfs
+	Type MountType
+	// Source is the name of a volume or the host path of a bind mount;
+	// tmpfs mounts have none
+	Source string
+	// Target is the absolute path the mount appears at in the container
+	Target   string
+	ReadOnly bool
+	// Retention of volumes, delete (default) or retain
+	Retention VolumeRetention
+	// SizeBytes limits the size of tmpfs mounts; 0 means unlimited
+	SizeBytes int64
+}
+
+func (m *Mount) GetType() MountType {
+	if m.Type == "" {
+		return VolumeMount
+	}
+	return m.Type
+}
+
+func (m *Mount) GetRetention() VolumeRetention {
+	if m.Retention == "" {
+		return DeleteVolume
+	}
+	return m.Retention
+}
+
+// volumeName matches the volume names docker accepts.
+var volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// validateMounts checks that the mounts are well formed and do not share
+// targets.
+func validateMounts(mounts []Mount) []error {
+	var errs []error
+	targets := make(map[string]bool)
+	for _, m := range mounts {
+		if !path.IsAbs(m.Target) {
+			errs = append(errs, fmt.Errorf("mount target %q is not an absolute path", m.Target))
+		} else if targets[path.Clean(m.Target)] {
+			errs = append(errs, fmt.Errorf("mount target %q is used twice", m.Target))
+		}
+		targets[path.Clean(m.Target)] = true
+
+		switch m.GetType() {
+		case VolumeMount:
+			if !volumeName.MatchString(m.Source) {
+				errs = append(errs, fmt.Errorf("invalid volume name %q", m.Source))
+			}
+			if r := m.GetRetention(); r != DeleteVolume && r != RetainVolume {
+				errs = append(errs, fmt.Errorf("unknown retention %q of volume %q", r, m.Source))
+			}
+		case BindMount:
+			if !path.IsAbs(m.Source) {
+				errs = append(errs, fmt.Errorf("bind mount source %q is not an absolute path", m.Source))
+			}
+		case TmpfsMount:
+			if m.Source != "" {
+				errs = append(errs, fmt.Errorf("tmpfs mount at %q cannot have a source", m.Target))
+			}
+			if m.SizeBytes < 0 {
+				errs = append(errs, fmt.Errorf("tmpfs mount at %q has a negative size", m.Target))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown mount type %q", m.Type))
+		}
+		if m.GetType() != VolumeMount && m.Retention != "" {
+			errs = append(errs, fmt.Errorf("only volumes have a retention, not %v mount at %q", m.GetType(), m.Target))
+		}
+	}
+	return errs
+}
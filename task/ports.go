@@ -0,0 +1,86 @@
+package task
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// PublishedPorts returns the container ports of the task, from both
+// ExposedPorts and PortBindings, mapped to the host port requested for
+// them, or to "" when any host port will do.
+func (t *Task) PublishedPorts() (map[nat.Port]string, error) {
+	ports := make(map[nat.Port]string)
+	for p := range t.ExposedPorts {
+		port, err := parsePort(string(p))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exposed port %q: %w", p, err)
+		}
+		ports[port] = ""
+	}
+
+	bound := make(map[nat.Port]nat.Port)
+	for containerPort, hostPort := range t.PortBindings {
+		port, err := parsePort(containerPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid container port %q: %w", containerPort, err)
+		}
+		if hostPort == "" {
+			ports[port] = ""
+			continue
+		}
+		host, err := parsePort(hostPort + "/" + port.Proto())
+		if err != nil {
+			return nil, fmt.Errorf("invalid host port %q for %v: %w", hostPort, port, err)
+		}
+		if other, ok := bound[host]; ok {
+			return nil, fmt.Errorf("host port %v is bound to both %v and %v", host, other, port)
+		}
+		bound[host] = port
+		ports[port] = host.Port()
+	}
+	return ports, nil
+}
+
+// RequestedHostPorts returns the host ports, like "8080/tcp", that the
+// task requested in its PortBindings.
+func (t *Task) RequestedHostPorts() []nat.Port {
+	var ports []nat.Port
+	published, _ := t.PublishedPorts()
+	for p, host := range published {
+		if host != "" {
+			ports = append(ports, nat.Port(host+"/"+p.Proto()))
+		}
+	}
+	return ports
+}
+
+// BoundHostPorts returns the host ports that the task requested or was
+// published on.
+func (t *Task) BoundHostPorts() []nat.Port {
+	ports := t.RequestedHostPorts()
+	for p, bindings := range t.HostPorts {
+		for _, b := range bindings {
+			if b.HostPort != "" {
+				ports = append(ports, nat.Port(b.HostPort+"/"+p.Proto()))
+			}
+		}
+	}
+	return ports
+}
+
+// parsePort parses a port like "80", which defaults to tcp, or "53/udp".
+func parsePort(raw string) (nat.Port, error) {
+	proto, port := nat.SplitProtoPort(raw)
+	switch proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", fmt.Errorf("unknown protocol %q", proto)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("port %q is not between 1 and 65535", port)
+	}
+	return nat.Port(fmt.Sprintf("%d/%s", n, proto)), nil
+}
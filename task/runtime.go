@@ -0,0 +1,97 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+var ErrContainerNotFound = errors.New("container not found")
+
+// Runtime runs the containers backing tasks. Methods taking a container id
+// also accept the container name, and return an error wrapping
+// ErrContainerNotFound when there is no such container.
+type Runtime interface {
+	Pull(ctx context.Context, image string, opts PullOptions) error
+	// ImageExists tells whether the image is present locally.
+	ImageExists(ctx context.Context, image string) (bool, error)
+	// ListImages returns the images present locally.
+	ListImages(ctx context.Context) ([]ImageInfo, error)
+	// RemoveImage removes a tag of a local image, or the image with the
+	// given id, along with the image once it has no tags left. It fails
+	// while containers use the image.
+	RemoveImage(ctx context.Context, image string) error
+	Create(ctx context.Context, c *Config) (string, error)
+	Start(ctx context.Context, containerID string) error
+	Stop(ctx context.Context, containerID string) error
+	Remove(ctx context.Context, containerID string) error
+	Inspect(ctx context.Context, containerID string) (*ContainerInfo, error)
+	// Logs writes the container's output to stdout and stderr, blocking
+	// until the output ends or, when following, ctx is done.
+	Logs(ctx context.Context, containerID string, opts LogsOptions, stdout, stderr io.Writer) error
+	Stats(ctx context.Context, containerID string) (*ContainerStats, error)
+	Exec(ctx context.Context, containerID string, cmd []string) (*ExecResult, error)
+	// ExecStream runs cmd in the container with its input read from stdin
+	// and its output written to stdout and stderr as it is produced, and
+	// returns its exit code.
+	ExecStream(ctx context.Context, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	// DiskUsage returns the size of the writable layer of the container in
+	// bytes.
+	DiskUsage(ctx context.Context, containerID string) (int64, error)
+	// CreateVolume creates the named volume, unless it already exists.
+	CreateVolume(ctx context.Context, name string) error
+	// RemoveVolume removes the named volume, failing while a container
+	// uses it.
+	RemoveVolume(ctx context.Context, name string) error
+}
+
+type ContainerInfo struct {
+	ID         string
+	Name       string
+	Image      string
+	Running    bool
+	ExitCode   int
+	OOMKilled  bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Ports      nat.PortMap
+}
+
+type ImageInfo struct {
+	ID   string
+	Tags []string
+	// RepoDigests are the digest references of the image, such as
+	// "nginx@sha256:...", which tasks pinning it use.
+	RepoDigests []string
+	Size        int64
+	Created     time.Time
+}
+
+type LogsOptions struct {
+	Follow     bool
+	Tail       string
+	Since      string
+	Timestamps bool
+}
+
+type ExecResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+type ContainerStats struct {
+	Time time.Time
+	// CpuPercent is the share of a single host cpu in use, so a container
+	// busy on two cores reports 200.
+	CpuPercent      float64
+	MemoryUsage     uint64
+	MemoryLimit     uint64
+	NetworkRxBytes  uint64
+	NetworkTxBytes  uint64
+	BlockReadBytes  uint64
+	BlockWriteBytes uint64
+}
@@ -1,5 +1,7 @@
 package task
 
+import "fmt"
+
 type State int
 
 const (
@@ -10,12 +12,40 @@ const (
 	Failed
 )
 
+// States lists every task state, in lifecycle order.
+var States = []State{Pending, Scheduled, Running, Completed, Failed}
+
+func (s State) String() string {
+	switch s {
+	case Pending:
+		return "Pending"
+	case Scheduled:
+		return "Scheduled"
+	case Running:
+		return "Running"
+	case Completed:
+		return "Completed"
+	case Failed:
+		return "Failed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
 var stateTtansiitonMap = map[State][]State{
 	Pending:   {Scheduled},
 	Scheduled: {Running, Failed},
 	Running:   {Completed, Failed},
 	Completed: {},
-	Failed:    {},
+	// Stopping a failed task removes what is left of it
+	Failed: {Completed},
+}
+
+// restartTransitionMap lists the transitions that are only valid when the
+// manager restarts a task.
+var restartTransitionMap = map[State][]State{
+	Running: {Scheduled},
+	Failed:  {Scheduled},
 }
 
 func Contains(states []State, state State) bool {
@@ -33,3 +63,7 @@ func ValidStateTransition(src State, dst State) bool {
 	}
 	return Contains(stateTtansiitonMap[src], dst)
 }
+
+func ValidRestartTransition(src State, dst State) bool {
+	return ValidStateTransition(src, dst) || Contains(restartTransitionMap[src], dst)
+}
@@ -1,21 +1,19 @@
 package task
 
 import (
-	"context"
-	"io"
-	"log"
-	"math"
-	"os"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
 	"time"
 
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
-	"github.com/moby/moby/pkg/stdcopy"
 )
 
+// MinMemory is the lowest memory limit docker accepts, in bytes.
+const MinMemory = 6 * 1024 * 1024
+
 type Task struct {
 	ID            uuid.UUID
 	ContainerID   string
@@ -26,10 +24,102 @@ type Task struct {
 	Memory        int64
 	Disk          int64
 	ExposedPorts  nat.PortSet
-	PortBindings  map[string]string
+	PortBindings  map[string]string // "80/tcp" -> "8080", or "" for any port of the worker's range
 	RestartPolicy string
 	StartTime     time.Time
 	FinishTime    time.Time
+	// HostPorts are the host ports the worker published the ports on
+	HostPorts      nat.PortMap
+	HealthCheck    *HealthCheck
+	HealthFailures int
+	RestartCount   int
+	// Entrypoint and Cmd replace the ENTRYPOINT and CMD of the image, and
+	// Args are appended to Cmd.
+	Entrypoint []string
+	Cmd        []string
+	Args       []string
+	// Env holds "KEY=value" variables set in addition to those of the image
+	Env []string
+	// WorkingDir replaces the working directory of the image; it must be an
+	// absolute path.
+	WorkingDir string
+	// Mounts are the volumes, host paths and tmpfs mounted into the
+	// container. Bind mounts are restricted to the paths the worker allows.
+	Mounts []Mount
+	// Reason tells why the task failed, e.g. that its container ran out of
+	// memory.
+	Reason string
+	// PullPolicy is Always, IfNotPresent (default) or Never
+	PullPolicy PullPolicy
+	// RegistryAuth names the registry credentials of the worker to pull
+	// the image with. By default those of the image's registry are used.
+	RegistryAuth string
+	// Events are the latest steps of the task on its worker, like the
+	// progress of pulling its image.
+	Events []Event
+	// AttachStdin, AttachStdout and AttachStderr attach the streams of the
+	// container's main process.
+	AttachStdin  bool
+	AttachStdout bool
+	AttachStderr bool
+}
+
+// MaxEvents is how many of its latest events a task keeps.
+const MaxEvents = 50
+
+// Event is a step in the life of a task on its worker.
+type Event struct {
+	Time    time.Time
+	Message string
+}
+
+// AddEvent records an event, dropping the oldest ones beyond MaxEvents.
+func (t *Task) AddEvent(message string) {
+	t.Events = append(t.Events, Event{Time: time.Now().UTC(), Message: message})
+	if len(t.Events) > MaxEvents {
+		t.Events = t.Events[len(t.Events)-MaxEvents:]
+	}
+}
+
+// Validate checks that the container settings of the task are well formed.
+func (t *Task) Validate() error {
+	var errs []error
+	for _, arg := range []struct {
+		name string
+		cmd  []string
+	}{{"entrypoint", t.Entrypoint}, {"cmd", t.Cmd}} {
+		if len(arg.cmd) > 0 && arg.cmd[0] == "" {
+			errs = append(errs, fmt.Errorf("%s must start with an executable", arg.name))
+		}
+	}
+	for _, env := range t.Env {
+		key, _, ok := strings.Cut(env, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t\n") {
+			errs = append(errs, fmt.Errorf("env %q is not of the form KEY=value", env))
+		}
+	}
+	if t.WorkingDir != "" && !path.IsAbs(t.WorkingDir) {
+		errs = append(errs, fmt.Errorf("working dir %q is not an absolute path", t.WorkingDir))
+	}
+	if _, err := t.PublishedPorts(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, validateMounts(t.Mounts)...)
+	if t.HealthCheck != nil {
+		errs = append(errs, t.HealthCheck.validate()...)
+	}
+	if t.Cpu < 0 || t.Memory < 0 || t.Disk < 0 {
+		errs = append(errs, errors.New("cpu, memory and disk cannot be negative"))
+	}
+	if t.Memory > 0 && t.Memory < MinMemory {
+		errs = append(errs, fmt.Errorf("memory limit of %d bytes is below the minimum of %d", t.Memory, MinMemory))
+	}
+	switch t.GetPullPolicy() {
+	case PullAlways, PullIfNotPresent, PullNever:
+	default:
+		errs = append(errs, fmt.Errorf("unknown pull policy %q", t.PullPolicy))
+	}
+	return errors.Join(errs...)
 }
 
 type TaskEvent struct {
@@ -46,41 +136,46 @@ type Config struct {
 	AttachStdout bool
 	AttachStderr bool
 	ExposedPorts nat.PortSet
-	// Cmd to be run inside container (optional)
-	Cmd    []string
-	Image  string
-	Cpu    float64
-	Memory int64
-	Disk   int64
-	Env    []string
-
-	// container's RestartPolicy ["", "always", "unless-stopped", "on-failure"]
-	RestartPolicy string
+	// PortBindings publish container ports on the given host ports
+	PortBindings nat.PortMap
+	// Entrypoint and Cmd to be run inside container (optional), replacing
+	// those of the image
+	Entrypoint []string
+	Cmd        []string
+	WorkingDir string
+	Image      string
+	Cpu        float64
+	Memory     int64
+	Disk       int64
+	Env        []string
+	Mounts     []Mount
 }
 
 func NewConfig(t *Task) *Config {
 	return &Config{
-		Name:          t.Name,
-		ExposedPorts:  t.ExposedPorts,
-		Image:         t.Image,
-		Cpu:           t.Cpu,
-		Memory:        t.Memory,
-		Disk:          t.Disk,
-		RestartPolicy: t.RestartPolicy,
+		Name:         t.Name,
+		AttachStdin:  t.AttachStdin,
+		AttachStdout: t.AttachStdout,
+		AttachStderr: t.AttachStderr,
+		ExposedPorts: t.ExposedPorts,
+		Entrypoint:   t.Entrypoint,
+		Cmd:          command(t),
+		WorkingDir:   t.WorkingDir,
+		Env:          t.Env,
+		Mounts:       t.Mounts,
+		Image:        t.Image,
+		Cpu:          t.Cpu,
+		Memory:       t.Memory,
+		Disk:         t.Disk,
 	}
 }
 
-type Docker struct {
-	Client *client.Client
-	Config Config
-}
-
-func NewDocker(c *Config) *Docker {
-	dc, _ := client.NewClientWithOpts(client.FromEnv)
-	return &Docker{
-		Client: dc,
-		Config: *c,
+// command returns the Cmd of the task followed by its Args.
+func command(t *Task) []string {
+	if len(t.Args) == 0 {
+		return t.Cmd
 	}
+	return append(append([]string{}, t.Cmd...), t.Args...)
 }
 
 type DockerResult struct {
@@ -89,80 +184,3 @@ type DockerResult struct {
 	ContainerId string
 	Result      string
 }
-
-func (d *Docker) Run() DockerResult {
-	ctx := context.Background()
-	reader, err := d.Client.ImagePull(ctx, d.Config.Image, image.PullOptions{})
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-	io.Copy(os.Stdout, reader)
-	err = reader.Close()
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-
-	rp := container.RestartPolicy{
-		Name: container.RestartPolicyMode(d.Config.RestartPolicy),
-	}
-
-	r := container.Resources{
-		Memory:   d.Config.Memory,
-		NanoCPUs: int64(d.Config.Cpu * math.Pow(10, 9)),
-	}
-
-	cc := container.Config{
-		Image:        d.Config.Image,
-		Tty:          false,
-		Env:          d.Config.Env,
-		ExposedPorts: d.Config.ExposedPorts,
-	}
-
-	hc := container.HostConfig{
-		RestartPolicy:   rp,
-		Resources:       r,
-		PublishAllPorts: true,
-	}
-	_, _ = cc, hc
-
-	resp, err := d.Client.ContainerCreate(ctx, &cc, &hc, nil, nil, d.Config.Name)
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-
-	err = d.Client.ContainerStart(ctx, resp.ID, container.StartOptions{})
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-
-	logOpts := container.LogsOptions{ShowStdout: true, ShowStderr: true}
-	out, err := d.Client.ContainerLogs(ctx, resp.ID, logOpts)
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-	stdcopy.StdCopy(os.Stdout, os.Stderr, out)
-	err = out.Close()
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-
-	return DockerResult{ContainerId: resp.ID, Action: "start", Result: "success"}
-}
-
-func (d *Docker) Stop(id string) DockerResult {
-	log.Printf("Attempting to stop container %v", id)
-	ctx := context.Background()
-	err := d.Client.ContainerStop(ctx, id, container.StopOptions{})
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-	err = d.Client.ContainerRemove(ctx, id, container.RemoveOptions{
-		RemoveVolumes: true,
-		RemoveLinks:   false,
-		Force:         false,
-	})
-	if err != nil {
-		return DockerResult{Error: err}
-	}
-	return DockerResult{Action: "stop", Result: "success"}
-}
@@ -1,7 +1,10 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -26,15 +29,43 @@ func (api *Api) initRouter() {
 		r.Get("/", api.GetTaskHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
 			r.Delete("/", api.StopTaskHandler)
+			r.Get("/health", api.HealthCheckTaskHandler)
+			r.Get("/stats", api.GetTaskStatsHandler)
+			r.Get("/logs", api.GetTaskLogsHandler)
+			r.Post("/exec", api.ExecTaskHandler)
+			r.Get("/exec/ws", api.ExecTaskStreamHandler)
 		})
 	})
+	api.Router.Route("/images", func(r chi.Router) {
+		r.Get("/", api.GetImagesHandler)
+		r.Post("/", api.PrepullImagesHandler)
+	})
 	api.Router.Route("/stats", func(r chi.Router) {
 		r.Get("/", api.GetStatsHandler)
 	})
+	api.Router.Handle("/metrics", api.Worker.MetricsHandler())
+}
+
+// Handler returns the api's router, e.g. to serve it from a test server.
+func (api *Api) Handler() http.Handler {
+	if api.Router == nil {
+		api.initRouter()
+	}
+	return api.Router
 }
 
-func (api *Api) Start() {
-	api.initRouter()
-	url := fmt.Sprintf("%s:%d", api.Address, api.Port)
-	http.ListenAndServe(url, api.Router)
+// Start serves the api until ctx is done.
+func (api *Api) Start(ctx context.Context) {
+	server := http.Server{
+		Addr:    fmt.Sprintf("%s:%d", api.Address, api.Port),
+		Handler: api.Handler(),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Error serving worker api: %v\n", err)
+	}
 }
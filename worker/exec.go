@@ -0,0 +1,173 @@
+package worker
+
+import (
+	"context"
+	"dumch/cube/task"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+type ExecRequest struct {
+	Cmd []string
+}
+
+// Streams of the messages of an interactive exec session.
+const (
+	StdinStream  = "stdin"
+	StdoutStream = "stdout"
+	StderrStream = "stderr"
+	ExitStream   = "exit"
+)
+
+// ExecMessage is a websocket message of an interactive exec session.
+// Clients send stdin messages, the worker sends the command's output and
+// finally an exit message with its exit code or the error running it.
+type ExecMessage struct {
+	Stream string
+	Data   string `json:",omitempty"`
+	// Close on a stdin message ends the command's input
+	Close    bool   `json:",omitempty"`
+	ExitCode int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+var upgrader = websocket.Upgrader{}
+
+// ExecTaskHandler runs a command inside a running task's container and
+// responds with its exit code and output.
+func (api *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	t, status, err := api.runningTask(r)
+	if err != nil {
+		respondError(w, status, err)
+		return
+	}
+
+	req := ExecRequest{}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && len(req.Cmd) == 0 {
+		err = errors.New("Cmd is required")
+	}
+	if err != nil {
+		respondError(w, 400, err)
+		return
+	}
+
+	result, err := api.Worker.Runtime.Exec(r.Context(), t.ContainerID, req.Cmd)
+	if err != nil {
+		respondError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(result)
+}
+
+// ExecTaskStreamHandler runs the command given by the cmd query parameters,
+// one per argument, inside a running task's container and connects it to
+// the client over a websocket exchanging ExecMessages.
+func (api *Api) ExecTaskStreamHandler(w http.ResponseWriter, r *http.Request) {
+	t, status, err := api.runningTask(r)
+	cmd := r.URL.Query()["cmd"]
+	if err != nil {
+		respondError(w, status, err)
+		return
+	}
+	if len(cmd) == 0 {
+		respondError(w, 400, errors.New("cmd is required"))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading exec of task %v: %v\n", t.ID, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdin, stdinWriter := io.Pipe()
+	go func() {
+		// The session ends when the client goes away.
+		defer cancel()
+		for {
+			msg := ExecMessage{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				stdinWriter.CloseWithError(err)
+				return
+			}
+			if msg.Stream != StdinStream {
+				continue
+			}
+			if msg.Data != "" {
+				stdinWriter.Write([]byte(msg.Data))
+			}
+			if msg.Close {
+				stdinWriter.Close()
+			}
+		}
+	}()
+
+	out := &execWriter{conn: conn}
+	exitCode, err := api.Worker.Runtime.ExecStream(ctx, t.ContainerID, cmd,
+		stdin, out.stream(StdoutStream), out.stream(StderrStream))
+	exit := ExecMessage{Stream: ExitStream, ExitCode: exitCode}
+	if err != nil {
+		exit.Error = err.Error()
+	}
+	out.send(exit)
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// runningTask looks up the task of the request, which has to be running,
+// and otherwise returns the status to respond with.
+func (api *Api) runningTask(r *http.Request) (*task.Task, int, error) {
+	tID, _ := uuid.Parse(chi.URLParam(r, "taskID"))
+	t, err := api.Worker.Db.Get(tID.String())
+	if err != nil {
+		return nil, 404, fmt.Errorf("No task with ID %v found", tID)
+	}
+	if t.State != task.Running {
+		return nil, 409, fmt.Errorf("Task %v is not running", tID)
+	}
+	return t, 200, nil
+}
+
+// execWriter sends the output of a command as ExecMessages.
+type execWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+type execStream struct {
+	out  *execWriter
+	name string
+}
+
+func (e *execWriter) stream(name string) io.Writer {
+	return &execStream{out: e, name: name}
+}
+
+func (e *execWriter) send(msg ExecMessage) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.conn.WriteJSON(msg)
+}
+
+func (s *execStream) Write(p []byte) (int, error) {
+	err := s.out.send(ExecMessage{Stream: s.name, Data: string(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
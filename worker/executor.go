@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"dumch/cube/task"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// executor runs task events on a bounded number of goroutines. Events of
+// the same task are applied one at a time, in the order they were submitted,
+// by the goroutine already working on the task.
+type executor struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	// backlog holds the events waiting for a task that is being worked on
+	backlog map[uuid.UUID][]task.Task
+}
+
+func newExecutor(concurrency int) *executor {
+	return &executor{
+		slots:   make(chan struct{}, max(concurrency, 1)),
+		backlog: make(map[uuid.UUID][]task.Task),
+	}
+}
+
+// submit runs the event with fn once earlier events of the same task were
+// applied. Unless the task is being worked on, it blocks until a slot is
+// free, so that a burst of events waits in the caller's queue.
+func (e *executor) submit(t task.Task, fn func(task.Task)) {
+	e.mu.Lock()
+	if backlog, busy := e.backlog[t.ID]; busy {
+		e.backlog[t.ID] = append(backlog, t)
+		e.mu.Unlock()
+		return
+	}
+	e.backlog[t.ID] = nil
+	e.mu.Unlock()
+
+	e.slots <- struct{}{}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer func() { <-e.slots }()
+		for {
+			fn(t)
+
+			e.mu.Lock()
+			backlog := e.backlog[t.ID]
+			if len(backlog) == 0 {
+				delete(e.backlog, t.ID)
+				e.mu.Unlock()
+				return
+			}
+			t, e.backlog[t.ID] = backlog[0], backlog[1:]
+			e.mu.Unlock()
+		}
+	}()
+}
+
+// wait blocks until all submitted events were applied.
+func (e *executor) wait() {
+	e.wg.Wait()
+}
+
+// taskLocks holds a mutex per task, for as long as it is locked or waited
+// for.
+type taskLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*taskLock
+}
+
+type taskLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the task and returns the function unlocking it.
+func (l *taskLocks) lock(taskID uuid.UUID) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[uuid.UUID]*taskLock)
+	}
+	tl, ok := l.locks[taskID]
+	if !ok {
+		tl = &taskLock{}
+		l.locks[taskID] = tl
+	}
+	tl.refs++
+	l.mu.Unlock()
+
+	tl.Lock()
+	return func() {
+		tl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if tl.refs--; tl.refs == 0 {
+			delete(l.locks, taskID)
+		}
+	}
+}
@@ -1,16 +1,31 @@
 package worker
 
 import (
+	"dumch/cube/stats"
 	"dumch/cube/task"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 )
 
+// respondError responds with status and an ErrResponse describing err.
+func respondError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := ErrResponse{
+		Message:        err.Error(),
+		HTTPStatusCode: status,
+	}
+	json.NewEncoder(w).Encode(e)
+}
+
 func (api *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 	d := json.NewDecoder(r.Body)
 	d.DisallowUnknownFields()
@@ -28,6 +43,10 @@ func (api *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(e)
 		return
 	}
+	if err := te.Task.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("Invalid task: %w", err))
+		return
+	}
 	api.Worker.AddTask(te.Task)
 	log.Printf("Added task %v\n", te.Task.ID)
 	w.WriteHeader(201)
@@ -49,8 +68,8 @@ func (api *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tID, _ := uuid.Parse(taskID)
-	taskToStop, ok := api.Worker.Db[tID]
-	if !ok {
+	taskToStop, err := api.Worker.Db.Get(tID.String())
+	if err != nil {
 		log.Printf("No task with ID %v found", tID)
 		w.WriteHeader(404)
 		return
@@ -64,8 +83,141 @@ func (api *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+// GetStatsHandler responds with the current stats or, when any of the
+// since, until and step query parameters is given, with the stats history
+// of that time range downsampled to one point per step.
 func (api *Api) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	if !q.Has("since") && !q.Has("until") && !q.Has("step") {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(api.Worker.GetStats())
+		return
+	}
+
+	history := api.Worker.History
+	if history == nil {
+		w.WriteHeader(404)
+		e := ErrResponse{
+			Message:        "Stats history is not kept",
+			HTTPStatusCode: 404,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	since, until, step, err := parseRange(q, history)
+	if err != nil {
+		w.WriteHeader(400)
+		e := ErrResponse{
+			Message:        err.Error(),
+			HTTPStatusCode: 400,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(history.Downsample(since, until, step))
+}
+
+// parseRange reads the time range of a stats query, which defaults to the
+// whole history at its own resolution.
+func parseRange(q url.Values, history *stats.History) (time.Time, time.Time, time.Duration, error) {
+	now := time.Now().UTC()
+	since, err := parseTime(q.Get("since"), now.Add(-history.Retention()))
+	if err != nil {
+		return since, now, 0, err
+	}
+	until, err := parseTime(q.Get("until"), now)
+	if err != nil {
+		return since, until, 0, err
+	}
+	step, err := parseStep(q.Get("step"), history.Resolution())
+	return since, until, step, err
+}
+
+// parseTime parses a query parameter given as RFC 3339 or unix seconds.
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected RFC 3339 or unix seconds", value)
+	}
+	return t, nil
+}
+
+// parseStep parses a step such as "1m", which may not be finer than the
+// resolution of the history.
+func parseStep(value string, resolution time.Duration) (time.Duration, error) {
+	if value == "" {
+		return resolution, nil
+	}
+	step, err := time.ParseDuration(value)
+	if err != nil || step <= 0 {
+		return 0, fmt.Errorf("invalid step %q, expected a duration such as 1m", value)
+	}
+	return max(step, resolution), nil
+}
+
+// HealthCheckTaskHandler runs the task's exec health check and responds
+// with 200 when it passed and 503 when it did not.
+func (api *Api) HealthCheckTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := chi.URLParam(r, "taskID")
+	tID, _ := uuid.Parse(taskID)
+	t, err := api.Worker.Db.Get(tID.String())
+	if err != nil {
+		log.Printf("No task with ID %v found", tID)
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := api.Worker.CheckTaskHealth(*t)
+	if err != nil {
+		w.WriteHeader(503)
+		e := ErrResponse{
+			Message:        err.Error(),
+			HTTPStatusCode: 503,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	if result.ExitCode != 0 {
+		w.WriteHeader(503)
+	} else {
+		w.WriteHeader(200)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetTaskStatsHandler responds with the resource usage of a running task's
+// container.
+func (api *Api) GetTaskStatsHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := chi.URLParam(r, "taskID")
+	tID, _ := uuid.Parse(taskID)
+	t, err := api.Worker.Db.Get(tID.String())
+	if err != nil {
+		log.Printf("No task with ID %v found", tID)
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	s, err := api.Worker.GetTaskStats(*t)
+	if err != nil {
+		w.WriteHeader(404)
+		e := ErrResponse{
+			Message:        err.Error(),
+			HTTPStatusCode: 404,
+		}
+		json.NewEncoder(w).Encode(e)
+		return
+	}
 	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(api.Worker.Stats)
+	json.NewEncoder(w).Encode(s)
 }
@@ -0,0 +1,222 @@
+package worker
+
+import (
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/task"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultImageGCPeriod = 5 * time.Minute
+	// Once disk usage reaches the high threshold, in percent, unused
+	// images are removed until it is back below the low one.
+	DefaultImageGCHighThreshold = 85
+	DefaultImageGCLowThreshold  = 80
+)
+
+// Image is an image cached on the worker.
+type Image struct {
+	task.ImageInfo
+	// LastUsed is when a task last started with the image or it was
+	// pulled, zero if that did not happen since the worker started.
+	LastUsed time.Time
+	// InUse tells whether tasks of the worker reference the image, which
+	// keeps it from being garbage collected.
+	InUse bool
+}
+
+type PrepullRequest struct {
+	Images []string
+}
+
+type PrepullResult struct {
+	Image string
+	Error string `json:",omitempty"`
+}
+
+// normalizeImage returns the reference docker lists an image by, e.g.
+// "nginx:latest" for "docker.io/library/nginx", or "nginx@sha256:..." for
+// "docker.io/library/nginx:1.25@sha256:...".
+func normalizeImage(ref string) string {
+	if strings.HasPrefix(ref, "sha256:") {
+		return ref
+	}
+	name, digest, pinned := strings.Cut(ref, "@")
+	tagged := strings.Contains(name[strings.LastIndex(name, "/")+1:], ":")
+	if pinned && tagged {
+		// Digests are listed without the tag they were pulled with.
+		name = name[:strings.LastIndex(name, ":")]
+	} else if !pinned && !tagged {
+		name += ":latest"
+	}
+	name = strings.TrimPrefix(name, task.DefaultRegistry+"/")
+	name = strings.TrimPrefix(name, "library/")
+	if pinned {
+		return name + "@" + digest
+	}
+	return name
+}
+
+// touchImage records that the image was just used.
+func (w *Worker) touchImage(ref string) {
+	w.imagesMu.Lock()
+	defer w.imagesMu.Unlock()
+	if w.imagesUsed == nil {
+		w.imagesUsed = make(map[string]time.Time)
+	}
+	w.imagesUsed[normalizeImage(ref)] = time.Now().UTC()
+}
+
+// GetImages returns the images cached on the worker.
+func (w *Worker) GetImages(ctx context.Context) ([]Image, error) {
+	infos, err := w.Runtime.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	for _, t := range w.GetTasks() {
+		referenced[normalizeImage(t.Image)] = true
+	}
+
+	w.imagesMu.Lock()
+	defer w.imagesMu.Unlock()
+	images := []Image{}
+	for _, info := range infos {
+		img := Image{ImageInfo: info, InUse: referenced[info.ID]}
+		for _, ref := range slices.Concat(info.Tags, info.RepoDigests) {
+			ref = normalizeImage(ref)
+			img.InUse = img.InUse || referenced[ref]
+			if used := w.imagesUsed[ref]; used.After(img.LastUsed) {
+				img.LastUsed = used
+			}
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// PrepullImages pulls the images with the worker's registry credentials,
+// so that the first tasks using them start quickly.
+func (w *Worker) PrepullImages(ctx context.Context, images []string) []PrepullResult {
+	results := []PrepullResult{}
+	for _, ref := range images {
+		result := PrepullResult{Image: ref}
+		auth, err := w.registryAuth(&task.Task{Image: ref})
+		if err == nil {
+			err = w.Runtime.Pull(ctx, ref, task.PullOptions{Auth: auth})
+		}
+		if err != nil {
+			log.Printf("Error pre-pulling image %v: %v\n", ref, err)
+			result.Error = err.Error()
+		} else {
+			w.touchImage(ref)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// GarbageCollectImages removes unused images every ImageGCPeriod when the
+// disk is filling up, until ctx is done.
+func (w *Worker) GarbageCollectImages(ctx context.Context) {
+	loop.Run(ctx, w.ImageGCPeriod, nil, func() {
+		w.collectImages(ctx)
+	})
+}
+
+// collectImages removes the least recently used images that no task
+// references, once disk usage crossed ImageGCHighThreshold, until enough
+// space is freed to get below ImageGCLowThreshold.
+func (w *Worker) collectImages(ctx context.Context) {
+	s := w.GetStats()
+	if s == nil || s.DiskStats == nil || s.DiskTotal() == 0 {
+		return
+	}
+	high, low := w.ImageGCHighThreshold, w.ImageGCLowThreshold
+	if high <= 0 {
+		high, low = DefaultImageGCHighThreshold, DefaultImageGCLowThreshold
+	}
+	total, used := float64(s.DiskTotal()), float64(s.DiskUsed())
+	if used/total*100 < high {
+		return
+	}
+	toFree := int64(used - low/100*total)
+	log.Printf("Disk usage is %.1f%%, removing unused images to free %d bytes\n", used/total*100, toFree)
+
+	images, err := w.GetImages(ctx)
+	if err != nil {
+		log.Printf("Error listing images: %v\n", err)
+		return
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		if !images[i].LastUsed.Equal(images[j].LastUsed) {
+			return images[i].LastUsed.Before(images[j].LastUsed)
+		}
+		return images[i].Created.Before(images[j].Created)
+	})
+	for _, img := range images {
+		if toFree <= 0 {
+			return
+		}
+		if img.InUse {
+			continue
+		}
+		// Removing the last tag removes the image.
+		refs := img.Tags
+		if len(refs) == 0 {
+			refs = []string{img.ID}
+		}
+		if err := w.removeImage(ctx, refs); err != nil {
+			log.Printf("Error removing image %v: %v\n", img.ID, err)
+			continue
+		}
+		log.Printf("Removed image %v of %d bytes\n", img.ID, img.Size)
+		toFree -= img.Size
+	}
+}
+
+func (w *Worker) removeImage(ctx context.Context, refs []string) error {
+	for _, ref := range refs {
+		if err := w.Runtime.RemoveImage(ctx, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (api *Api) GetImagesHandler(w http.ResponseWriter, r *http.Request) {
+	images, err := api.Worker.GetImages(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, fmt.Errorf("listing images: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(images)
+}
+
+// PrepullImagesHandler pulls the requested images and reports, for each
+// of them, whether that worked.
+func (api *Api) PrepullImagesHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepullRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("Error unmarshalling body: %w", err))
+		return
+	}
+	if len(req.Images) == 0 {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("no images to pull"))
+		return
+	}
+	results := api.Worker.PrepullImages(r.Context(), req.Images)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"bytes"
+	"dumch/cube/task"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// GetTaskLogsHandler streams the output of a task's container. The follow,
+// tail, since and timestamps query parameters map to task.LogsOptions.
+// Clients accepting text/event-stream get a server-sent event per line,
+// named after the stream it was written to, others get the raw output.
+func (api *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := chi.URLParam(r, "taskID")
+	tID, _ := uuid.Parse(taskID)
+	t, err := api.Worker.Db.Get(tID.String())
+	if err != nil {
+		log.Printf("No task with ID %v found", tID)
+		w.WriteHeader(404)
+		return
+	}
+
+	opts, err := parseLogsOptions(r.URL.Query())
+	if err != nil {
+		respondError(w, 400, err)
+		return
+	}
+	if _, err := api.Worker.Runtime.Inspect(r.Context(), t.ContainerID); t.ContainerID == "" || err != nil {
+		respondError(w, 404, fmt.Errorf("Task %v has no container to read logs from", t.ID))
+		return
+	}
+
+	var stdout, stderr io.Writer
+	var events *eventWriter
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		events = &eventWriter{w: w}
+		stdout, stderr = events.stream("stdout"), events.stream("stderr")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		out := &flushWriter{w: w}
+		stdout, stderr = out, out
+	}
+	w.WriteHeader(200)
+
+	err = api.Worker.Runtime.Logs(r.Context(), t.ContainerID, opts, stdout, stderr)
+	if events != nil {
+		events.flush()
+	}
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Error streaming logs of task %v: %v\n", t.ID, err)
+	}
+}
+
+func parseLogsOptions(q url.Values) (task.LogsOptions, error) {
+	opts := task.LogsOptions{Tail: q.Get("tail"), Since: q.Get("since")}
+	var err error
+	if v := q.Get("follow"); v != "" {
+		if opts.Follow, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("invalid follow %q", v)
+		}
+	}
+	if v := q.Get("timestamps"); v != "" {
+		if opts.Timestamps, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("invalid timestamps %q", v)
+		}
+	}
+	if opts.Tail != "" && opts.Tail != "all" {
+		if n, err := strconv.Atoi(opts.Tail); err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid tail %q, expected a number of lines or all", opts.Tail)
+		}
+	}
+	return opts, nil
+}
+
+// flushWriter sends every write to the client right away. Stdout and
+// stderr share it, so writes are serialized.
+type flushWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// eventWriter sends output as server-sent events, one per line.
+type eventWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	streams []*eventStream
+}
+
+type eventStream struct {
+	events  *eventWriter
+	name    string
+	partial []byte
+}
+
+func (e *eventWriter) stream(name string) io.Writer {
+	s := &eventStream{events: e, name: name}
+	e.streams = append(e.streams, s)
+	return s
+}
+
+// flush sends the last lines that did not end with a newline.
+func (e *eventWriter) flush() {
+	for _, s := range e.streams {
+		if len(s.partial) > 0 {
+			e.send(s.name, s.partial)
+			s.partial = nil
+		}
+	}
+}
+
+func (e *eventWriter) send(name string, line []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", name, bytes.TrimSuffix(line, []byte("\r")))
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return err
+}
+
+func (s *eventStream) Write(p []byte) (int, error) {
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		err := s.events.send(s.name, s.partial[:i])
+		s.partial = s.partial[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
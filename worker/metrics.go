@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"dumch/cube/stats"
+	"dumch/cube/task"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandler serves the worker's metrics in the prometheus text format.
+func (w *Worker) MetricsHandler() http.Handler {
+	tasks := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cube_worker_tasks",
+		Help: "Number of tasks known to the worker, by state.",
+	}, []string{"state"})
+	queued := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cube_worker_queued_tasks",
+		Help: "Number of tasks waiting to be started or stopped.",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(tasks, queued, stats.NewCollector(func() map[string]*stats.Stats {
+		return map[string]*stats.Stats{w.Name: w.GetStats()}
+	}))
+
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		counts := make(map[task.State]int)
+		for _, t := range w.GetTasks() {
+			counts[t.State]++
+		}
+		for _, state := range task.States {
+			tasks.WithLabelValues(state.String()).Set(float64(counts[state]))
+		}
+		queued.Set(float64(w.Queue.Len()))
+		handler.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"dumch/cube/task"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+// DefaultPortRange is where host ports are picked from by default, below
+// the ephemeral ports docker publishes on by itself.
+var DefaultPortRange = PortRange{Start: 30000, End: 32767}
+
+var ErrPortInUse = errors.New("host port already in use")
+
+// PortRange is a range of host ports, both ends included.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// ParsePortRange parses a range like "30000-32767".
+func ParsePortRange(s string) (PortRange, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return PortRange{}, fmt.Errorf("port range %q is not of the form start-end", s)
+	}
+	r := PortRange{}
+	var err1, err2 error
+	r.Start, err1 = strconv.Atoi(start)
+	r.End, err2 = strconv.Atoi(end)
+	if err1 != nil || err2 != nil || r.Start < 1 || r.End > 65535 || r.Start > r.End {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// allocatePorts binds each port of t to the host port it requested, or to
+// a free one from the worker's PortRange. The host ports stay reserved
+// for t until releasePorts is called.
+func (w *Worker) allocatePorts(t *task.Task) (nat.PortMap, error) {
+	ports, err := t.PublishedPorts()
+	if err != nil {
+		return nil, err
+	}
+	// Requested ports go first, so that they are not handed out to others.
+	containerPorts := make([]nat.Port, 0, len(ports))
+	for p := range ports {
+		containerPorts = append(containerPorts, p)
+	}
+	sort.Slice(containerPorts, func(i, j int) bool {
+		pi, pj := containerPorts[i], containerPorts[j]
+		if (ports[pi] == "") != (ports[pj] == "") {
+			return ports[pi] != ""
+		}
+		return pi < pj
+	})
+
+	w.portsMu.Lock()
+	defer w.portsMu.Unlock()
+	used := w.usedPorts(t.ID)
+	r := w.PortRange
+	if r == (PortRange{}) {
+		r = DefaultPortRange
+	}
+
+	bindings := nat.PortMap{}
+	var reserved []nat.Port
+	for _, p := range containerPorts {
+		host := ports[p]
+		if host != "" {
+			if used[nat.Port(host+"/"+p.Proto())] {
+				return nil, fmt.Errorf("%w: %s/%s", ErrPortInUse, host, p.Proto())
+			}
+		} else {
+			for port := r.Start; port <= r.End; port++ {
+				if !used[nat.Port(fmt.Sprintf("%d/%s", port, p.Proto()))] {
+					host = strconv.Itoa(port)
+					break
+				}
+			}
+			if host == "" {
+				return nil, fmt.Errorf("no free host port in range %v for %v", r, p)
+			}
+		}
+		hostPort := nat.Port(host + "/" + p.Proto())
+		used[hostPort] = true
+		reserved = append(reserved, hostPort)
+		bindings[p] = []nat.PortBinding{{HostPort: host}}
+	}
+
+	if w.reservedPorts == nil {
+		w.reservedPorts = make(map[uuid.UUID][]nat.Port)
+	}
+	w.reservedPorts[t.ID] = reserved
+	return bindings, nil
+}
+
+// releasePorts drops the reservation of the host ports of a task, once
+// they are recorded on the task itself.
+func (w *Worker) releasePorts(id uuid.UUID) {
+	w.portsMu.Lock()
+	defer w.portsMu.Unlock()
+	delete(w.reservedPorts, id)
+}
+
+// usedPorts returns the host ports reserved for, requested by or bound to
+// the active tasks other than the given one.
+func (w *Worker) usedPorts(except uuid.UUID) map[nat.Port]bool {
+	used := make(map[nat.Port]bool)
+	for id, ports := range w.reservedPorts {
+		if id == except {
+			continue
+		}
+		for _, p := range ports {
+			used[p] = true
+		}
+	}
+	for _, t := range w.GetTasks() {
+		if t.ID == except || (t.State != task.Scheduled && t.State != task.Running) {
+			continue
+		}
+		for _, p := range t.BoundHostPorts() {
+			used[p] = true
+		}
+	}
+	return used
+}
@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/node"
+	"dumch/cube/stats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errNotRegistered = errors.New("worker is not registered with the manager")
+
+// Heartbeat registers the worker as node n with the manager at managerUrl
+// (e.g. "http://localhost:5556") and then reports the worker's stats every
+// interval until ctx is done. The worker registers again whenever the
+// manager does not know it, e.g. after the manager restarted.
+func (w *Worker) Heartbeat(ctx context.Context, managerUrl string, n node.Node, interval time.Duration) {
+	registered := false
+	loop.Run(ctx, interval, nil, func() {
+		var err error
+		if registered {
+			err = w.sendHeartbeat(managerUrl, n.Name)
+			if errors.Is(err, errNotRegistered) {
+				registered = false
+			}
+		}
+		if !registered {
+			err = w.register(managerUrl, n)
+			registered = err == nil
+		}
+		if err != nil {
+			log.Printf("Error reporting to manager %v: %v\n", managerUrl, err)
+		}
+	})
+}
+
+func (w *Worker) register(managerUrl string, n node.Node) error {
+	if s := w.GetStats(); s != nil {
+		n.UpdateStats(s)
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/nodes", managerUrl)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("registration responded with status %d", resp.StatusCode)
+	}
+	log.Printf("Registered as node %v with manager %v\n", n.Name, managerUrl)
+	return nil
+}
+
+func (w *Worker) sendHeartbeat(managerUrl string, name string) error {
+	s := w.GetStats()
+	if s == nil {
+		s = &stats.Stats{}
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/nodes/%s/heartbeat", managerUrl, name)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return errNotRegistered
+	default:
+		return fmt.Errorf("heartbeat responded with status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"context"
+	"dumch/cube/task"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadRegistryAuths reads registry credentials from a file in the format
+// of docker's config.json, keyed by registry host:
+//
+//	{"auths": {
+//		"ghcr.io": {"username": "bot", "password": "secret"},
+//		"registry.example.com": {"auth": "<base64 of username:password>"}
+//	}}
+func LoadRegistryAuths(path string) (map[string]task.RegistryAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	auths := make(map[string]task.RegistryAuth)
+	for server, entry := range config.Auths {
+		auth := task.RegistryAuth{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: server,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decoding credentials for %s: %w", server, err)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		auths[registryKey(server)] = auth
+	}
+	return auths, nil
+}
+
+// registryKey turns a server address like "https://index.docker.io/v1/"
+// into the registry host of images, here "docker.io".
+func registryKey(server string) string {
+	host := server
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return task.DefaultRegistry
+	}
+	return host
+}
+
+// registryAuth returns the credentials t references, or else those of the
+// registry of its image, if any.
+func (w *Worker) registryAuth(t *task.Task) (*task.RegistryAuth, error) {
+	if t.RegistryAuth != "" {
+		auth, ok := w.Registries[registryKey(t.RegistryAuth)]
+		if !ok {
+			return nil, fmt.Errorf("no registry credentials for %q", t.RegistryAuth)
+		}
+		return &auth, nil
+	}
+	if auth, ok := w.Registries[task.RegistryHost(t.Image)]; ok {
+		return &auth, nil
+	}
+	return nil, nil
+}
+
+// pullImage makes the image of t available according to its pull policy,
+// recording the progress of the pull as events of the task.
+func (w *Worker) pullImage(t *task.Task) error {
+	ctx := context.Background()
+	w.touchImage(t.Image)
+	policy := t.GetPullPolicy()
+	if policy != task.PullAlways {
+		present, err := w.Runtime.ImageExists(ctx, t.Image)
+		if err != nil {
+			return err
+		}
+		if present {
+			return nil
+		}
+		if policy == task.PullNever {
+			return fmt.Errorf("image %s is not present and the pull policy is %v", t.Image, policy)
+		}
+	}
+
+	auth, err := w.registryAuth(t)
+	if err != nil {
+		return err
+	}
+	t.AddEvent(fmt.Sprintf("Pulling image %s", t.Image))
+	w.saveTask(t)
+	// Layers report the same status many times while they download.
+	seen := make(map[task.PullProgress]bool)
+	err = w.Runtime.Pull(ctx, t.Image, task.PullOptions{
+		Auth: auth,
+		Progress: func(p task.PullProgress) {
+			if seen[p] || p.Status == "" {
+				return
+			}
+			seen[p] = true
+			t.AddEvent(p.String())
+			w.saveTask(t)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	t.AddEvent(fmt.Sprintf("Pulled image %s", t.Image))
+	return nil
+}
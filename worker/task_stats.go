@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"context"
+	"dumch/cube/task"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// taskSample is the last resource usage sample of a task's container.
+type taskSample struct {
+	containerID string
+	stats       *task.ContainerStats
+}
+
+// collectTaskStats samples the resource usage of the containers of running
+// tasks and forgets samples of tasks that are no longer running.
+func (w *Worker) collectTaskStats() {
+	tasks, err := w.Db.List()
+	if err != nil {
+		log.Printf("Error listing tasks to collect stats: %v\n", err)
+		return
+	}
+
+	sampled := make(map[uuid.UUID]taskSample)
+	for _, t := range tasks {
+		if t.State != task.Running || t.ContainerID == "" {
+			continue
+		}
+		s, err := w.Runtime.Stats(context.Background(), t.ContainerID)
+		if err != nil {
+			log.Printf("Error collecting stats of task %v: %v\n", t.ID, err)
+			continue
+		}
+		sampled[t.ID] = taskSample{containerID: t.ContainerID, stats: s}
+	}
+
+	w.statsMu.Lock()
+	w.taskStats = sampled
+	w.statsMu.Unlock()
+}
+
+// GetTaskStats returns the last resource usage sample of a running task,
+// sampling it right away when its container started after the last
+// collection.
+func (w *Worker) GetTaskStats(t task.Task) (*task.ContainerStats, error) {
+	if t.State != task.Running {
+		return nil, fmt.Errorf("task %v is not running", t.ID)
+	}
+	w.statsMu.RLock()
+	sample, ok := w.taskStats[t.ID]
+	w.statsMu.RUnlock()
+	if ok && sample.containerID == t.ContainerID {
+		return sample.stats, nil
+	}
+
+	s, err := w.Runtime.Stats(context.Background(), t.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	w.statsMu.Lock()
+	if w.taskStats == nil {
+		w.taskStats = make(map[uuid.UUID]taskSample)
+	}
+	w.taskStats[t.ID] = taskSample{containerID: t.ContainerID, stats: s}
+	w.statsMu.Unlock()
+	return s, nil
+}
@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"context"
+	"dumch/cube/task"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+var ErrBindNotAllowed = errors.New("bind mount not allowed")
+
+// checkBindMounts makes sure the bind mounts of t are below one of the
+// AllowedBindPaths, after resolving symlinks.
+func (w *Worker) checkBindMounts(t *task.Task) error {
+	for _, m := range t.Mounts {
+		if m.GetType() != task.BindMount {
+			continue
+		}
+		if !w.bindAllowed(m.Source) {
+			return fmt.Errorf("%w: %s", ErrBindNotAllowed, m.Source)
+		}
+	}
+	return nil
+}
+
+func (w *Worker) bindAllowed(source string) bool {
+	source = resolvePath(source)
+	for _, allowed := range w.AllowedBindPaths {
+		allowed = resolvePath(allowed)
+		if source == allowed || strings.HasPrefix(source, strings.TrimSuffix(allowed, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath cleans p and resolves the symlinks in it, as far as it
+// exists.
+func resolvePath(p string) string {
+	p = filepath.Clean(p)
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	return p
+}
+
+// createVolumes creates the named volumes of t that do not exist yet.
+func (w *Worker) createVolumes(t *task.Task) error {
+	for _, m := range t.Mounts {
+		if m.GetType() != task.VolumeMount {
+			continue
+		}
+		if err := w.Runtime.CreateVolume(context.Background(), m.Source); err != nil {
+			return fmt.Errorf("creating volume %s: %w", m.Source, err)
+		}
+	}
+	return nil
+}
+
+// removeVolumes removes the named volumes of a stopped task, or one that
+// failed to start, that are not retained, unless other scheduled or
+// running tasks mount them too. Failed tasks keep their container and
+// volumes until they are stopped, as the manager may restart them.
+func (w *Worker) removeVolumes(t task.Task) {
+	inUse := make(map[string]bool)
+	for _, other := range w.GetTasks() {
+		if other.ID == t.ID || (other.State != task.Scheduled && other.State != task.Running) {
+			continue
+		}
+		for _, m := range other.Mounts {
+			if m.GetType() == task.VolumeMount {
+				inUse[m.Source] = true
+			}
+		}
+	}
+
+	for _, m := range t.Mounts {
+		if m.GetType() != task.VolumeMount || m.GetRetention() != task.DeleteVolume {
+			continue
+		}
+		if inUse[m.Source] {
+			log.Printf("Keeping volume %v of task %v, other tasks use it\n", m.Source, t.ID)
+			continue
+		}
+		if err := w.Runtime.RemoveVolume(context.Background(), m.Source); err != nil {
+			log.Printf("Error removing volume %v of task %v: %v\n", m.Source, t.ID, err)
+		}
+	}
+}
@@ -1,81 +1,374 @@
 package worker
 
 import (
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/queue"
 	"dumch/cube/stats"
+	"dumch/cube/store"
 	"dumch/cube/task"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/golang-collections/collections/queue"
+	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
 )
 
+const (
+	DefaultConcurrency     = 4
+	DefaultRunPeriod       = 10 * time.Second
+	DefaultUpdatePeriod    = 15 * time.Second
+	DefaultStatsResolution = 15 * time.Second
+	DefaultStatsRetention  = time.Hour
+)
+
 type Worker struct {
-	Name      string
-	Queue     queue.Queue
-	Db        map[uuid.UUID]*task.Task
-	Stats     *stats.Stats
-	TaskCount int
+	Name    string
+	Queue   queue.Queue[task.Task]
+	Db      store.Store[*task.Task]
+	Runtime task.Runtime
+	// History keeps past stats; they are collected once per its resolution
+	History *stats.History
+	// Concurrency limits how many tasks RunTasks starts or stops at once
+	Concurrency int
+	// PortRange is where host ports are picked from for container ports
+	// without a requested one.
+	PortRange PortRange
+	// AllowedBindPaths are the host paths tasks may bind mount, along with
+	// everything below them. Without any, bind mounts are refused.
+	AllowedBindPaths []string
+	// Registries holds the credentials to pull images with, by registry
+	// host like "ghcr.io".
+	Registries map[string]task.RegistryAuth
+	// ImageGCPeriod is how often unused images are garbage collected once
+	// disk usage, in percent, crossed ImageGCHighThreshold.
+	ImageGCPeriod        time.Duration
+	ImageGCHighThreshold float64
+	ImageGCLowThreshold  float64
+	// RunPeriod is the longest queued tasks wait when the worker missed
+	// their arrival, and UpdatePeriod how often containers are inspected.
+	RunPeriod    time.Duration
+	UpdatePeriod time.Duration
+	// wake signals RunTasks that a task was queued
+	wake loop.Signal
+	cpu  stats.CpuSampler
+	// portsMu guards the host ports allocated to tasks that are starting
+	portsMu       sync.Mutex
+	reservedPorts map[uuid.UUID][]nat.Port
+	// imagesMu guards when each image was last used
+	imagesMu   sync.Mutex
+	imagesUsed map[string]time.Time
+	// statsMu guards the last host stats and the last resource usage
+	// sample of each running task
+	statsMu   sync.RWMutex
+	hostStats *stats.Stats
+	taskStats map[uuid.UUID]taskSample
+	// taskLocks keeps changes made to a task while its containers are
+	// inspected from overlapping with the events applied to it
+	taskLocks taskLocks
 }
 
-func (w *Worker) CollectStats() {
-	for {
+// New creates a worker running tasks on rt and keeping them in a store of
+// dbType, e.g. "persistent". Tasks restored from a previous run are
+// reconciled with the containers that are actually present.
+func New(name string, dbType string, rt task.Runtime) (*Worker, error) {
+	db, err := store.New[*task.Task](dbType, fmt.Sprintf("%s_tasks.db", name), "tasks")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create task store: %w", err)
+	}
+	history, err := stats.NewHistory(DefaultStatsResolution, DefaultStatsRetention)
+	if err != nil {
+		return nil, err
+	}
+	w := Worker{
+		Name:                 name,
+		Db:                   db,
+		Runtime:              rt,
+		History:              history,
+		Concurrency:          DefaultConcurrency,
+		PortRange:            DefaultPortRange,
+		ImageGCPeriod:        DefaultImageGCPeriod,
+		ImageGCHighThreshold: DefaultImageGCHighThreshold,
+		ImageGCLowThreshold:  DefaultImageGCLowThreshold,
+		RunPeriod:            DefaultRunPeriod,
+		UpdatePeriod:         DefaultUpdatePeriod,
+		wake:                 loop.NewSignal(),
+	}
+	w.reconcileTasks()
+	return &w, nil
+}
+
+// reconcileTasks re-adopts the containers of persisted tasks that are
+// still running and marks tasks whose container is gone as failed.
+func (w *Worker) reconcileTasks() {
+	w.inspectTasks(task.Scheduled, task.Running)
+}
+
+// UpdateTasks checks the containers of running tasks every UpdatePeriod,
+// so that tasks whose container exited are reported as completed or
+// failed, until ctx is done.
+func (w *Worker) UpdateTasks(ctx context.Context) {
+	loop.Run(ctx, w.UpdatePeriod, nil, func() {
+		log.Println("Checking status of tasks")
+		w.InspectRunningTasks()
+		log.Println("Task updates completed")
+	})
+}
+
+func (w *Worker) InspectRunningTasks() {
+	w.inspectTasks(task.Running)
+	w.enforceDiskLimits()
+}
+
+// enforceDiskLimits fails the running tasks whose container wrote more to
+// its writable layer than the task's Disk allows, and removes the
+// container.
+func (w *Worker) enforceDiskLimits() {
+	ctx := context.Background()
+	for _, t := range w.GetTasks() {
+		if t.State != task.Running || t.Disk <= 0 {
+			continue
+		}
+		usage, err := w.Runtime.DiskUsage(ctx, t.ContainerID)
+		if err != nil {
+			log.Printf("Unable to get disk usage of task %v: %v\n", t.ID, err)
+			continue
+		}
+		if usage <= t.Disk {
+			continue
+		}
+
+		log.Printf("Task %v uses %d bytes of disk, more than its limit of %d\n", t.ID, usage, t.Disk)
+		w.failTask(t.ID, t.ContainerID,
+			fmt.Sprintf("container wrote %d bytes to disk, exceeding its limit of %d bytes", usage, t.Disk))
+	}
+}
+
+// failTask removes the container of a running task and marks the task
+// failed, unless it was stopped or restarted since containerID was read.
+func (w *Worker) failTask(taskID uuid.UUID, containerID string, reason string) {
+	defer w.taskLocks.lock(taskID)()
+	t, err := w.Db.Get(taskID.String())
+	if err != nil {
+		log.Printf("Error getting task %v: %v\n", taskID, err)
+		return
+	}
+	if t.State != task.Running || t.ContainerID != containerID {
+		return
+	}
+	if result := w.stop(t.ContainerID); result.Error != nil {
+		log.Printf("Error removing container %v: %v\n", t.ContainerID, result.Error)
+	}
+	t.State = task.Failed
+	t.FinishTime = time.Now().UTC()
+	t.Reason = reason
+	w.saveTask(t)
+}
+
+// inspectTasks syncs tasks in the given states with their containers.
+func (w *Worker) inspectTasks(states ...task.State) {
+	tasks, err := w.Db.List()
+	if err != nil {
+		log.Printf("Error listing tasks to inspect: %v\n", err)
+		return
+	}
+
+	for _, t := range tasks {
+		if task.Contains(states, t.State) {
+			w.inspectTask(t)
+		}
+	}
+}
+
+// inspectTask syncs a listed task with its container, unless the task was
+// stopped or restarted since it was listed.
+func (w *Worker) inspectTask(listed *task.Task) {
+	defer w.taskLocks.lock(listed.ID)()
+	t, err := w.Db.Get(listed.ID.String())
+	if err != nil {
+		log.Printf("Error getting task %v: %v\n", listed.ID, err)
+		return
+	}
+	if t.State != listed.State || t.ContainerID != listed.ContainerID {
+		return
+	}
+
+	ref := t.ContainerID
+	if ref == "" {
+		ref = t.Name
+	}
+	info, err := w.Runtime.Inspect(context.Background(), ref)
+	switch {
+	case errors.Is(err, task.ErrContainerNotFound):
+		log.Printf("Container for task %v is gone, marking it failed\n", t.ID)
+		t.State = task.Failed
+		t.FinishTime = time.Now().UTC()
+		t.Reason = "container is gone"
+	case err != nil:
+		log.Printf("Unable to inspect task %v: %v\n", t.ID, err)
+		return
+	case info.Running:
+		if t.ContainerID == info.ID && t.State == task.Running {
+			return
+		}
+		log.Printf("Re-adopting container %v for task %v\n", info.ID, t.ID)
+		t.ContainerID = info.ID
+		t.HostPorts = info.Ports
+		t.State = task.Running
+	case info.OOMKilled:
+		log.Printf("Container %v of task %v ran out of memory\n", info.ID, t.ID)
+		t.ContainerID = info.ID
+		t.State = task.Failed
+		t.FinishTime = time.Now().UTC()
+		t.Reason = fmt.Sprintf("container was killed for exceeding its memory limit of %d bytes", t.Memory)
+	case info.ExitCode == 0:
+		t.ContainerID = info.ID
+		t.State = task.Completed
+		t.FinishTime = time.Now().UTC()
+	default:
+		t.ContainerID = info.ID
+		t.State = task.Failed
+		t.FinishTime = time.Now().UTC()
+		t.Reason = fmt.Sprintf("container exited with code %d", info.ExitCode)
+	}
+
+	err = w.Db.Put(t.ID.String(), t)
+	if err != nil {
+		log.Printf("Error saving reconciled task %v: %v\n", t.ID, err)
+	}
+}
+
+// CollectStats collects stats once per resolution of the history until
+// ctx is done.
+func (w *Worker) CollectStats(ctx context.Context) {
+	interval := DefaultStatsResolution
+	if w.History != nil {
+		interval = w.History.Resolution()
+	}
+	loop.Run(ctx, interval, nil, func() {
 		log.Println("Collecting stats")
-		w.Stats = stats.GetStats()
-		w.Stats.TaskCount = w.TaskCount
-		time.Sleep(15 * time.Second)
+		w.collectStats()
+	})
+}
+
+func (w *Worker) collectStats() {
+	s := stats.GetStats()
+	cpu, err := w.cpu.Sample()
+	if err != nil {
+		log.Printf("Error collecting cpu stats: %v\n", err)
+	}
+	s.CpuStats = cpu
+	s.TaskCount = w.activeTasks()
+	w.statsMu.Lock()
+	w.hostStats = s
+	w.statsMu.Unlock()
+	if w.History != nil {
+		w.History.Add(time.Now().UTC(), s)
 	}
+	w.collectTaskStats()
+}
+
+// GetStats returns the last collected host stats, or nil before the first
+// collection.
+func (w *Worker) GetStats() *stats.Stats {
+	w.statsMu.RLock()
+	defer w.statsMu.RUnlock()
+	return w.hostStats
 }
 
 func (w *Worker) GetTasks() []*task.Task {
-	tasks := []*task.Task{}
-	for _, t := range w.Db {
-		tasks = append(tasks, t)
+	tasks, err := w.Db.List()
+	if err != nil {
+		log.Printf("Error getting list of tasks: %v\n", err)
+		return []*task.Task{}
 	}
 	return tasks
 }
 
+// activeTasks counts the tasks that are scheduled or running.
+func (w *Worker) activeTasks() int {
+	n := 0
+	for _, t := range w.GetTasks() {
+		if t.State == task.Scheduled || t.State == task.Running {
+			n++
+		}
+	}
+	return n
+}
+
 func (w *Worker) AddTask(t task.Task) {
 	w.Queue.Enqueue(t)
+	w.wake.Notify()
 }
 
-func (w *Worker) RunTasks() {
+// RunTasks runs queued tasks as soon as they are added, and at the latest
+// every RunPeriod, until ctx is done. Up to Concurrency tasks are started
+// or stopped at once, while the events of a single task apply in order.
+func (w *Worker) RunTasks(ctx context.Context) {
+	e := newExecutor(w.Concurrency)
+	loop.Run(ctx, w.RunPeriod, w.wake, func() {
+		w.runQueuedTasks(e)
+	})
+	e.wait()
+}
+
+func (w *Worker) runQueuedTasks(e *executor) {
+	if w.Queue.Len() == 0 {
+		log.Println("No tasks to process currently.")
+		return
+	}
 	for {
-		if w.Queue.Len() != 0 {
-			result := w.runTask()
+		t, ok := w.Queue.Dequeue()
+		if !ok {
+			return
+		}
+		e.submit(t, func(t task.Task) {
+			result := w.runTask(t)
 			if result.Error != nil {
-				log.Printf("Error running task: %v\n", result.Error)
+				log.Printf("Error running task %v: %v\n", t.ID, result.Error)
 			}
-		} else {
-			log.Println("No tasks to process currently.")
-		}
-		log.Println("Sleeping for 10 seconds.")
-		time.Sleep(10 * time.Second)
+		})
 	}
 }
 
-func (w *Worker) runTask() task.DockerResult {
-	t := w.Queue.Dequeue()
-	if t == nil {
+// RunTask applies the next queued task event and waits for it to finish.
+func (w *Worker) RunTask() task.DockerResult {
+	t, ok := w.Queue.Dequeue()
+	if !ok {
 		return task.DockerResult{Error: fmt.Errorf("no tasks in a queue")}
 	}
+	return w.runTask(t)
+}
 
-	taskQueued := t.(task.Task)
-	taskPersisted := w.Db[taskQueued.ID]
-
-	if taskPersisted == nil {
+func (w *Worker) runTask(taskQueued task.Task) task.DockerResult {
+	defer w.taskLocks.lock(taskQueued.ID)()
+	taskPersisted, err := w.Db.Get(taskQueued.ID.String())
+	if errors.Is(err, store.ErrNotFound) {
 		taskPersisted = &taskQueued
-		w.Db[taskQueued.ID] = &taskQueued
+		err = w.Db.Put(taskQueued.ID.String(), &taskQueued)
+	}
+	if err != nil {
+		return task.DockerResult{Error: err}
 	}
 
+	// The manager restarts a task by scheduling it again with a higher
+	// restart count.
+	restart := taskQueued.RestartCount > taskPersisted.RestartCount
+
 	var result task.DockerResult
-	if task.ValidStateTransition(taskPersisted.State, taskQueued.State) {
-		switch taskQueued.State {
-		case task.Scheduled:
+	if task.ValidStateTransition(taskPersisted.State, taskQueued.State) ||
+		restart && task.ValidRestartTransition(taskPersisted.State, taskQueued.State) {
+		switch {
+		case taskQueued.State == task.Scheduled && restart:
+			result = w.RestartTask(*taskPersisted, taskQueued)
+		case taskQueued.State == task.Scheduled:
 			result = w.StartTask(taskQueued)
-		case task.Completed:
+		case taskQueued.State == task.Completed:
+			// The stop may have been queued before the task started.
+			taskQueued.ContainerID = taskPersisted.ContainerID
 			result = w.StopTask(taskQueued)
 		default:
 			result.Error = errors.New("We should not get here")
@@ -90,36 +383,144 @@ func (w *Worker) runTask() task.DockerResult {
 
 func (w *Worker) StartTask(t task.Task) task.DockerResult {
 	t.StartTime = time.Now().UTC()
-	config := task.NewConfig(&t)
-	d := task.NewDocker(config)
-	result := d.Run()
+	defer w.releasePorts(t.ID)
+	var ports nat.PortMap
+	err := w.checkBindMounts(&t)
+	if err == nil {
+		ports, err = w.allocatePorts(&t)
+	}
+	if err == nil {
+		err = w.createVolumes(&t)
+	}
+	if err == nil {
+		err = w.pullImage(&t)
+	}
+	var result task.DockerResult
+	if err != nil {
+		result.Error = err
+	} else {
+		config := task.NewConfig(&t)
+		config.ExposedPorts = nat.PortSet{}
+		for p := range ports {
+			config.ExposedPorts[p] = struct{}{}
+		}
+		config.PortBindings = ports
+		t.HostPorts = ports
+		result = w.run(config)
+	}
 	if result.Error != nil {
 		log.Printf("Err running task %v: %v\n", t.ID, result.Error)
 		t.State = task.Failed
+		t.FinishTime = time.Now().UTC()
+		t.HostPorts = nil
+		t.Reason = result.Error.Error()
 	} else {
 		t.ContainerID = result.ContainerId
 		t.State = task.Running
+		t.Reason = ""
+		info, err := w.Runtime.Inspect(context.Background(), t.ContainerID)
+		if err != nil {
+			log.Printf("Error inspecting container %v: %v\n", t.ContainerID, err)
+		} else {
+			t.HostPorts = info.Ports
+		}
+	}
+	w.saveTask(&t)
+	if result.Error != nil {
+		w.removeVolumes(t)
 	}
-	w.Db[t.ID] = &t
 	return result
 }
 
-func (w *Worker) StopTask(t task.Task) task.DockerResult {
-	config := task.NewConfig(&t)
-	d := task.NewDocker(config)
+// RestartTask replaces the container of the old task with a new one for t.
+func (w *Worker) RestartTask(old task.Task, t task.Task) task.DockerResult {
+	log.Printf("Restarting task %v (restart %d)\n", t.ID, t.RestartCount)
+	if old.ContainerID != "" {
+		result := w.stop(old.ContainerID)
+		if result.Error != nil && !errors.Is(result.Error, task.ErrContainerNotFound) {
+			log.Printf("Error removing container %v of task %v: %v\n",
+				old.ContainerID, t.ID, result.Error)
+			return result
+		}
+	}
+	return w.StartTask(t)
+}
 
-	result := d.Stop(t.ContainerID)
+// CheckTaskHealth runs the exec health check of a task inside its container.
+func (w *Worker) CheckTaskHealth(t task.Task) (*task.ExecResult, error) {
+	if t.HealthCheck == nil || t.HealthCheck.Type != task.ExecHealthCheck {
+		return nil, fmt.Errorf("task %v has no exec health check", t.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.HealthCheck.GetTimeout())
+	defer cancel()
+	return w.Runtime.Exec(ctx, t.ContainerID, t.HealthCheck.Command)
+}
+
+func (w *Worker) StopTask(t task.Task) task.DockerResult {
+	result := task.DockerResult{Action: "stop", Result: "success"}
+	// A failed task may have no container left to stop.
+	if t.ContainerID != "" {
+		result = w.stop(t.ContainerID)
+		if errors.Is(result.Error, task.ErrContainerNotFound) {
+			result = task.DockerResult{Action: "stop", Result: "success"}
+		}
+	}
 	if result.Error != nil {
 		log.Printf("Error stopping container %v: %v\n",
 			t.ContainerID, result.Error)
 		t.State = task.Failed
+		t.Reason = result.Error.Error()
 	} else {
 		t.State = task.Completed
 	}
 	t.FinishTime = time.Now().UTC()
-	w.Db[t.ID] = &t
+	w.saveTask(&t)
+	if result.Error == nil {
+		w.removeVolumes(t)
+	}
 	log.Printf("Stopped and removed container %v for task %v\n",
 		t.ContainerID, t.ID)
 
 	return result
 }
+
+func (w *Worker) run(config *task.Config) task.DockerResult {
+	ctx := context.Background()
+	id, err := w.Runtime.Create(ctx, config)
+	if err != nil {
+		return task.DockerResult{Error: err}
+	}
+
+	err = w.Runtime.Start(ctx, id)
+	if err != nil {
+		// Do not leave the container behind, holding on to its name,
+		// ports and volumes.
+		if rmErr := w.Runtime.Remove(ctx, id); rmErr != nil {
+			log.Printf("Error removing container %v: %v\n", id, rmErr)
+		}
+		return task.DockerResult{Error: err}
+	}
+
+	return task.DockerResult{ContainerId: id, Action: "start", Result: "success"}
+}
+
+func (w *Worker) stop(containerID string) task.DockerResult {
+	log.Printf("Attempting to stop container %v", containerID)
+	ctx := context.Background()
+	err := w.Runtime.Stop(ctx, containerID)
+	if err != nil {
+		return task.DockerResult{Error: err}
+	}
+	err = w.Runtime.Remove(ctx, containerID)
+	if err != nil {
+		return task.DockerResult{Error: err}
+	}
+	return task.DockerResult{Action: "stop", Result: "success"}
+}
+
+func (w *Worker) saveTask(t *task.Task) {
+	err := w.Db.Put(t.ID.String(), t)
+	if err != nil {
+		log.Printf("Error saving task %v: %v\n", t.ID, err)
+	}
+}
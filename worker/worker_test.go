@@ -1,14 +1,31 @@
 package worker
 
 import (
+	"bytes"
+	"context"
+	"dumch/cube/loop"
+	"dumch/cube/node"
+	"dumch/cube/stats"
+	"dumch/cube/store"
 	"dumch/cube/task"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
-	"github.com/golang-collections/collections/queue"
+	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/shirou/gopsutil/disk"
 )
 
 func TestWoker(test *testing.T) {
@@ -19,55 +36,1045 @@ func TestWoker(test *testing.T) {
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
-	go startTaskOnWorker(w1, t1, &wg)
-	go startTaskOnWorker(w2, t2, &wg)
+	go startTaskOnWorker(test, w1, t1, &wg)
+	go startTaskOnWorker(test, w2, t2, &wg)
 
 	wg.Wait()
 	fmt.Println("Finished")
 }
 
 func TestApi(test *testing.T) {
-	host := "localhost" // os.Getenv("CUBE_HOST")
-	port := 5555        // os.Getenv("CUBE_PORT")
+	w := newWorker()
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := newTask(1)
+	data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		test.Fatalf("Error posting task: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		test.Fatalf("Expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error running task: %v", result.Error)
+	}
+
+	tasks := getTasks(test, server.URL)
+	if len(tasks) != 1 || tasks[0].State != task.Running {
+		test.Fatalf("Expected one running task, got %v", tasks)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/tasks/"+t.ID.String(), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		test.Fatalf("Error deleting task: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		test.Fatalf("Expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error stopping task: %v", result.Error)
+	}
+
+	tasks = getTasks(test, server.URL)
+	if len(tasks) != 1 || tasks[0].State != task.Completed {
+		test.Fatalf("Expected one completed task, got %v", tasks)
+	}
+}
+
+func TestStartTaskFailure(test *testing.T) {
+	w := newWorker()
+	w.Runtime.(*task.FakeRuntime).Errors["pull"] = fmt.Errorf("registry unavailable")
+
+	t := newTask(1)
+	w.AddTask(t)
+	if result := w.RunTask(); result.Error == nil {
+		test.Fatalf("Expected pull error")
+	}
+
+	persisted, _ := w.Db.Get(t.ID.String())
+	if persisted.State != task.Failed {
+		test.Fatalf("Expected task to fail, got state %v", persisted.State)
+	}
+
+	// A container that fails to start is removed again.
+	rt := w.Runtime.(*task.FakeRuntime)
+	delete(rt.Errors, "pull")
+	rt.Errors["start"] = fmt.Errorf("port is already allocated")
+	w.AddTask(newTask(2))
+	if result := w.RunTask(); result.Error == nil {
+		test.Fatalf("Expected start error")
+	}
+	if len(rt.Containers) != 0 {
+		test.Fatalf("Expected the container to be removed, got %v", rt.Containers)
+	}
+}
+
+func TestContainerSettings(test *testing.T) {
+	w := newWorker()
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := newTask(1)
+	t.Entrypoint = []string{"/bin/sh", "-c"}
+	t.Cmd = []string{"echo"}
+	t.Args = []string{"$GREETING"}
+	t.Env = []string{"GREETING=hello world"}
+	t.WorkingDir = "/srv"
+	t.AttachStdout, t.AttachStderr = true, true
+	data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+	resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		test.Fatalf("Error posting task: %v %v", err, resp.Status)
+	}
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error running task: %v", result.Error)
+	}
+
+	fc, _ := w.Runtime.(*task.FakeRuntime).Container(t.Name)
+	config := fc.Config
+	if !reflect.DeepEqual(config.Entrypoint, t.Entrypoint) ||
+		!reflect.DeepEqual(config.Cmd, []string{"echo", "$GREETING"}) ||
+		!reflect.DeepEqual(config.Env, t.Env) || config.WorkingDir != "/srv" ||
+		config.AttachStdin || !config.AttachStdout || !config.AttachStderr {
+		test.Fatalf("Task settings not passed to the container: %+v", config)
+	}
+
+	for _, invalid := range []func(t *task.Task){
+		func(t *task.Task) { t.Cmd = []string{"", "ls"} },
+		func(t *task.Task) { t.Env = []string{"GREETING"} },
+		func(t *task.Task) { t.Env = []string{"=hello"} },
+		func(t *task.Task) { t.WorkingDir = "srv" },
+		func(t *task.Task) { t.PortBindings = map[string]string{"80/tcp": "http"} },
+		func(t *task.Task) { t.PortBindings = map[string]string{"80/tcp": "8080", "81/tcp": "8080"} },
+		func(t *task.Task) { t.PullPolicy = "Sometimes" },
+		func(t *task.Task) { t.Mounts = []task.Mount{{Source: "data", Target: "data"}} },
+		func(t *task.Task) { t.Mounts = []task.Mount{{Source: "../data", Target: "/data"}} },
+		func(t *task.Task) { t.Mounts = []task.Mount{{Type: task.BindMount, Source: "srv", Target: "/srv"}} },
+		func(t *task.Task) { t.Mounts = []task.Mount{{Type: task.TmpfsMount, Source: "tmp", Target: "/tmp"}} },
+		func(t *task.Task) { t.Mounts = []task.Mount{{Source: "data", Target: "/data", Retention: "forever"}} },
+		func(t *task.Task) {
+			t.Mounts = []task.Mount{{Source: "data", Target: "/data"}, {Source: "cache", Target: "/data/"}}
+		},
+	} {
+		t := newTask(2)
+		invalid(&t)
+		data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+		resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			test.Fatalf("Error posting task: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			test.Fatalf("Expected status %d for %+v, got %d", http.StatusBadRequest, t, resp.StatusCode)
+		}
+	}
+	if w.Queue.Len() != 0 {
+		test.Fatalf("Expected invalid tasks not to be queued, got %d", w.Queue.Len())
+	}
+}
 
-	fmt.Println("Starting Cube worker")
+func TestPortBindings(test *testing.T) {
 	w := newWorker()
+	w.PortRange = PortRange{Start: 40000, End: 40001}
 
-	api := Api{Address: host, Port: port, Worker: &w}
+	web := newTask(1)
+	web.ExposedPorts = nat.PortSet{"443/tcp": {}}
+	web.PortBindings = map[string]string{"80": "8080", "53/udp": ""}
+	if t := runTask(test, w, web); t.State != task.Running {
+		test.Fatalf("Expected task to run, got %v", t.State)
+	}
+	fc, _ := w.Runtime.(*task.FakeRuntime).Container(web.Name)
+	expected := nat.PortMap{
+		"80/tcp":  {{HostPort: "8080"}},
+		"53/udp":  {{HostPort: "40000"}},
+		"443/tcp": {{HostPort: "40000"}},
+	}
+	if !reflect.DeepEqual(fc.Config.PortBindings, expected) {
+		test.Fatalf("Expected bindings %v, got %v", expected, fc.Config.PortBindings)
+	}
+	persisted, _ := w.Db.Get(web.ID.String())
+	if persisted.HostPorts["80/tcp"][0].HostPort != "8080" || persisted.HostPorts["443/tcp"][0].HostPort != "40000" {
+		test.Fatalf("Expected actual bindings on the task, got %v", persisted.HostPorts)
+	}
 
-	go w.RunTasks()
-	go w.CollectStats()
-	api.Start()
+	conflict := newTask(2)
+	conflict.PortBindings = map[string]string{"80/tcp": "8080"}
+	if t := runTask(test, w, conflict); t.State != task.Failed {
+		test.Fatalf("Expected task binding a used port to fail, got %v", t.State)
+	}
+
+	// Only 40001/tcp is left in the range.
+	exhausted := newTask(3)
+	exhausted.ExposedPorts = nat.PortSet{"80/tcp": {}, "81/tcp": {}}
+	if t := runTask(test, w, exhausted); t.State != task.Failed {
+		test.Fatalf("Expected task to fail without free ports, got %v", t.State)
+	}
+
+	web.State = task.Completed
+	runTask(test, w, web)
+	conflict = newTask(4)
+	conflict.PortBindings = map[string]string{"80/tcp": "8080"}
+	if t := runTask(test, w, conflict); t.State != task.Running {
+		test.Fatalf("Expected port to be free after the task stopped, got %v", t.State)
+	}
 }
 
-func startTaskOnWorker(w Worker, t task.Task, wg *sync.WaitGroup) {
+func TestMounts(test *testing.T) {
+	w := newWorker()
+	rt := w.Runtime.(*task.FakeRuntime)
+	dir := test.TempDir()
+	os.Mkdir(filepath.Join(dir, "www"), 0o755)
+	os.Symlink("/etc", filepath.Join(dir, "etc"))
+	w.AllowedBindPaths = []string{dir}
+
+	first := newTask(1)
+	first.Mounts = []task.Mount{
+		{Source: "data", Target: "/data"},
+		{Source: "cache", Target: "/cache", Retention: task.RetainVolume},
+		{Type: task.BindMount, Source: filepath.Join(dir, "www"), Target: "/www", ReadOnly: true},
+		{Type: task.TmpfsMount, Target: "/tmp", SizeBytes: 1 << 20},
+	}
+	second := newTask(2)
+	second.Mounts = []task.Mount{{Source: "data", Target: "/var/lib/data"}}
+	for _, t := range []task.Task{first, second} {
+		if persisted := runTask(test, w, t); persisted.State != task.Running {
+			test.Fatalf("Expected task %v to run, got %v", t.Name, persisted.State)
+		}
+	}
+	fc, _ := rt.Container(first.Name)
+	if !reflect.DeepEqual(fc.Config.Mounts, first.Mounts) || !rt.Volumes["data"] || !rt.Volumes["cache"] {
+		test.Fatalf("Expected mounts and volumes to be created, got %v and %v", fc.Config.Mounts, rt.Volumes)
+	}
+
+	for i, source := range []string{"/etc", filepath.Join(dir, "etc"), dir + "-other"} {
+		t := newTask(3 + i)
+		t.Mounts = []task.Mount{{Type: task.BindMount, Source: source, Target: "/etc"}}
+		if persisted := runTask(test, w, t); persisted.State != task.Failed {
+			test.Fatalf("Expected bind mount of %v to be refused, got %v", source, persisted.State)
+		}
+	}
+
+	// The data volume is still used by the second task.
+	first.State = task.Completed
+	runTask(test, w, first)
+	if !rt.Volumes["data"] || !rt.Volumes["cache"] {
+		test.Fatalf("Expected volumes in use or retained to be kept, got %v", rt.Volumes)
+	}
+	second.State = task.Completed
+	runTask(test, w, second)
+	if rt.Volumes["data"] || !rt.Volumes["cache"] {
+		test.Fatalf("Expected only the retained volume to be kept, got %v", rt.Volumes)
+	}
+
+	// Volumes created for a task that fails to start are removed again.
+	rt.Errors["start"] = fmt.Errorf("start failed")
+	failing := newTask(6)
+	failing.Mounts = []task.Mount{{Source: "scratch", Target: "/scratch"}}
+	if persisted := runTask(test, w, failing); persisted.State != task.Failed || rt.Volumes["scratch"] {
+		test.Fatalf("Expected task to fail without its volume, got %v and %v", persisted.State, rt.Volumes)
+	}
+	delete(rt.Errors, "start")
+
+	// Stopping a task whose container exited with an error removes the
+	// container and its volume.
+	exited := newTask(7)
+	exited.Mounts = []task.Mount{{Source: "scratch", Target: "/scratch"}}
+	persisted := runTask(test, w, exited)
+	rt.Exit(persisted.ContainerID, 1)
+	w.InspectRunningTasks()
+	exited.State = task.Completed
+	if persisted := runTask(test, w, exited); persisted.State != task.Completed || rt.Volumes["scratch"] {
+		test.Fatalf("Expected the failed task to be stopped without its volume, got %v and %v",
+			persisted.State, rt.Volumes)
+	}
+	if _, ok := rt.Container(exited.Name); ok {
+		test.Fatalf("Expected the exited container to be removed")
+	}
+}
+
+func TestResourceLimits(test *testing.T) {
+	w := newWorker()
+	rt := w.Runtime.(*task.FakeRuntime)
+
+	hungry := newTask(1)
+	hungry.Memory = 64 << 20
+	writer := newTask(2)
+	writer.Disk = 1 << 20
+	frugal := newTask(3)
+	frugal.Disk = 1 << 20
+	for _, t := range []task.Task{hungry, writer, frugal} {
+		if persisted := runTask(test, w, t); persisted.State != task.Running {
+			test.Fatalf("Expected task %v to run, got %v", t.Name, persisted.State)
+		}
+	}
+	persisted, _ := w.Db.Get(hungry.ID.String())
+	rt.OOMKill(persisted.ContainerID)
+	rt.SetDiskUsage(writer.Name, 2<<20)
+	rt.SetDiskUsage(frugal.Name, 1<<20)
+	w.InspectRunningTasks()
+
+	for _, tc := range []struct {
+		t      task.Task
+		state  task.State
+		reason string
+	}{
+		{hungry, task.Failed, "memory limit of 67108864 bytes"},
+		{writer, task.Failed, "exceeding its limit of 1048576 bytes"},
+		{frugal, task.Running, ""},
+	} {
+		persisted, _ := w.Db.Get(tc.t.ID.String())
+		if persisted.State != tc.state || !strings.Contains(persisted.Reason, tc.reason) ||
+			tc.reason == "" && persisted.Reason != "" {
+			test.Fatalf("Expected task %v to be %v with reason %q, got %v: %q",
+				tc.t.Name, tc.state, tc.reason, persisted.State, persisted.Reason)
+		}
+	}
+	if _, ok := rt.Container(writer.Name); ok {
+		test.Fatalf("Expected the container over its disk limit to be removed")
+	}
+
+	// A task stopped after its disk usage was checked stays completed.
+	persisted, _ = w.Db.Get(frugal.ID.String())
+	frugal.State = task.Completed
+	runTask(test, w, frugal)
+	w.failTask(frugal.ID, persisted.ContainerID, "too late")
+	if persisted, _ = w.Db.Get(frugal.ID.String()); persisted.State != task.Completed {
+		test.Fatalf("Expected the stopped task to stay completed, got %v", persisted.State)
+	}
+}
+
+func TestPullPolicy(test *testing.T) {
+	w := newWorker()
+	rt := w.Runtime.(*task.FakeRuntime)
+	run := func(number int, policy task.PullPolicy) *task.Task {
+		t := newTask(number)
+		t.PullPolicy = policy
+		return runTask(test, w, t)
+	}
+
+	never := run(1, task.PullNever)
+	if never.State != task.Failed || !strings.Contains(never.Reason, "not present") {
+		test.Fatalf("Expected task to fail without its image, got %v: %q", never.State, never.Reason)
+	}
+	first := run(2, "")
+	var events []string
+	for _, e := range first.Events {
+		events = append(events, e.Message)
+	}
+	expected := []string{"Pulling image strm/helloworld-http", "Pulling from strm/helloworld-http",
+		"layer: Pull complete", "Pulled image strm/helloworld-http"}
+	if !reflect.DeepEqual(events, expected) {
+		test.Fatalf("Expected pull events %v, got %v", expected, events)
+	}
+	for number, policy := range []task.PullPolicy{task.PullIfNotPresent, task.PullNever, task.PullAlways} {
+		if t := run(3+number, policy); t.State != task.Running {
+			test.Fatalf("Expected task with pull policy %v to run, got %v", policy, t.State)
+		}
+	}
+	if pulls := rt.Pulls["strm/helloworld-http"]; pulls != 2 {
+		test.Fatalf("Expected the image to be pulled twice, got %d", pulls)
+	}
+}
+
+func TestRegistryAuth(test *testing.T) {
+	config := filepath.Join(test.TempDir(), "config.json")
+	os.WriteFile(config, []byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "Ym9iOmh1bnRlcjI="},
+		"ghcr.io": {"username": "bot", "password": "secret"}
+	}}`), 0o600)
+	auths, err := LoadRegistryAuths(config)
+	if err != nil {
+		test.Fatalf("Error loading registry credentials: %v", err)
+	}
+
+	w := newWorker()
+	w.Registries = auths
+	rt := w.Runtime.(*task.FakeRuntime)
+	rt.Credentials["bob/private"] = task.RegistryAuth{Username: "bob", Password: "hunter2", ServerAddress: "https://index.docker.io/v1/"}
+	rt.Credentials["ghcr.io/owner/app"] = task.RegistryAuth{Username: "bot", Password: "secret", ServerAddress: "ghcr.io"}
+	rt.Credentials["mirror.example.com/owner/app"] = rt.Credentials["ghcr.io/owner/app"]
+
+	for number, tc := range []struct {
+		image string
+		auth  string
+		state task.State
+	}{
+		{"bob/private", "", task.Running},
+		{"ghcr.io/owner/app", "", task.Running},
+		{"mirror.example.com/owner/app", "", task.Failed},
+		{"mirror.example.com/owner/app", "ghcr.io", task.Running},
+		{"strm/helloworld-http", "quay.io", task.Failed},
+	} {
+		t := newTask(number)
+		t.Image, t.RegistryAuth = tc.image, tc.auth
+		if persisted := runTask(test, w, t); persisted.State != tc.state {
+			test.Fatalf("Expected task pulling %v with %q to be %v, got %v: %v",
+				tc.image, tc.auth, tc.state, persisted.State, persisted.Reason)
+		}
+	}
+}
+
+func TestImages(test *testing.T) {
+	w := newWorker()
+	rt := w.Runtime.(*task.FakeRuntime)
+	rt.Credentials["private/app"] = task.RegistryAuth{Username: "bob"}
+	rt.ImageSizes = map[string]int64{"nginx": 80, "redis:7": 20, "redis@sha256:1234": 30, "strm/helloworld-http": 50}
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	data, _ := json.Marshal(PrepullRequest{Images: []string{"nginx", "redis:7", "redis@sha256:1234", "private/app"}})
+	resp, err := http.Post(server.URL+"/images", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		test.Fatalf("Error pre-pulling images: %v", err)
+	}
+	var results []PrepullResult
+	json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if len(results) != 4 || results[0].Error != "" || results[1].Error != "" || results[2].Error != "" || results[3].Error == "" {
+		test.Fatalf("Expected only the private image to fail, got %v", results)
+	}
+
+	t := newTask(1)
+	w.AddTask(t)
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error running task: %v", result.Error)
+	}
+	// A task pinned to a digest, by a reference that is listed shorter
+	pinned := newTask(2)
+	pinned.Image = "docker.io/library/redis:7@sha256:1234"
+	pinned.State = task.Completed
+	w.Db.Put(pinned.ID.String(), &pinned)
+
+	resp, err = http.Get(server.URL + "/images")
+	if err != nil {
+		test.Fatalf("Error getting images: %v", err)
+	}
+	var images []Image
+	json.NewDecoder(resp.Body).Decode(&images)
+	resp.Body.Close()
+	if len(images) != 4 {
+		test.Fatalf("Expected 4 images, got %v", images)
+	}
+	for _, img := range images {
+		inUse := img.ID == "sha256:"+t.Image || img.ID == "sha256:redis@sha256:1234"
+		if img.LastUsed.IsZero() || img.InUse != inUse {
+			test.Fatalf("Unexpected image %+v", img)
+		}
+	}
+
+	// Images are removed least recently used first, until the disk usage
+	// drops below 80%, but never while a task references them.
+	for _, tc := range []struct {
+		used      uint64
+		remaining []string
+	}{
+		{840, []string{"nginx", "redis:7", "redis@sha256:1234", "strm/helloworld-http"}},
+		{870, []string{"redis:7", "redis@sha256:1234", "strm/helloworld-http"}},
+		{950, []string{"redis@sha256:1234", "strm/helloworld-http"}},
+	} {
+		w.hostStats = &stats.Stats{DiskStats: &disk.UsageStat{Total: 1000, Used: tc.used}}
+		w.collectImages(context.Background())
+		var remaining []string
+		for ref := range rt.Images {
+			remaining = append(remaining, ref)
+		}
+		sort.Strings(remaining)
+		if !reflect.DeepEqual(remaining, tc.remaining) {
+			test.Fatalf("Expected images %v with %d bytes used, got %v", tc.remaining, tc.used, remaining)
+		}
+	}
+}
+
+func TestInspectStoppedTask(test *testing.T) {
+	w := newWorker()
+	t := newTask(1)
+	listed := runTask(test, w, t)
+
+	// The task is stopped after it was listed for inspection.
+	t.State = task.Completed
+	runTask(test, w, t)
+	w.inspectTask(listed)
+
+	if persisted, _ := w.Db.Get(t.ID.String()); persisted.State != task.Completed || persisted.Reason != "" {
+		test.Fatalf("Expected the stopped task to stay completed, got %v: %q", persisted.State, persisted.Reason)
+	}
+}
+
+func TestReconcileTasks(test *testing.T) {
+	w := newWorker()
+	rt := w.Runtime.(*task.FakeRuntime)
+
+	running, gone, exited := newTask(1), newTask(2), newTask(3)
+	for _, t := range []task.Task{running, exited} {
+		w.AddTask(t)
+		if result := w.RunTask(); result.Error != nil {
+			test.Fatalf("Error starting task: %v", result.Error)
+		}
+	}
+	persisted, _ := w.Db.Get(exited.ID.String())
+	rt.Exit(persisted.ContainerID, 1)
+
+	gone.State = task.Running
+	gone.ContainerID = "fake-missing"
+	w.Db.Put(gone.ID.String(), &gone)
+
+	w.reconcileTasks()
+
+	expected := map[uuid.UUID]task.State{
+		running.ID: task.Running,
+		gone.ID:    task.Failed,
+		exited.ID:  task.Failed,
+	}
+	for id, state := range expected {
+		t, _ := w.Db.Get(id.String())
+		if t.State != state {
+			test.Fatalf("Expected task %v to be in state %v, got %v", t.Name, state, t.State)
+		}
+	}
+}
+
+func TestRegistrationAndHeartbeat(test *testing.T) {
+	var registered []node.Node
+	heartbeats := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nodes":
+			n := node.Node{}
+			json.NewDecoder(r.Body).Decode(&n)
+			registered = append(registered, n)
+			w.WriteHeader(http.StatusCreated)
+		case "/nodes/localhost:5555/heartbeat":
+			heartbeats++
+			if len(registered) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	w := newWorker()
+	n := node.NewNode("localhost:5555", "http://localhost:5555", "worker")
+
+	if err := w.sendHeartbeat(server.URL, n.Name); err != errNotRegistered {
+		test.Fatalf("Expected unregistered heartbeat to fail, got %v", err)
+	}
+	if err := w.register(server.URL, *n); err != nil {
+		test.Fatalf("Error registering: %v", err)
+	}
+	if err := w.sendHeartbeat(server.URL, n.Name); err != nil {
+		test.Fatalf("Error sending heartbeat: %v", err)
+	}
+	if len(registered) != 1 || registered[0].Name != n.Name || heartbeats != 2 {
+		test.Fatalf("Unexpected registrations %v and %d heartbeats", registered, heartbeats)
+	}
+}
+
+func TestTaskStats(test *testing.T) {
+	w := newWorker()
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := newTask(1)
+	w.AddTask(t)
+	result := w.RunTask()
+	if result.Error != nil {
+		test.Fatalf("Error starting task: %v", result.Error)
+	}
+	rt := w.Runtime.(*task.FakeRuntime)
+	rt.SetStats(result.ContainerId, task.ContainerStats{CpuPercent: 50, MemoryUsage: 64 << 20})
+	w.collectTaskStats()
+
+	resp, err := http.Get(server.URL + "/tasks/" + t.ID.String() + "/stats")
+	if err != nil {
+		test.Fatalf("Error getting task stats: %v", err)
+	}
+	s := task.ContainerStats{}
+	json.NewDecoder(resp.Body).Decode(&s)
+	if resp.StatusCode != http.StatusOK || s.CpuPercent != 50 || s.MemoryUsage != 64<<20 {
+		test.Fatalf("Unexpected stats %v with status %d", s, resp.StatusCode)
+	}
+
+	// The sample collected while the task ran is not reported any more.
+	rt.Exit(result.ContainerId, 0)
+	w.InspectRunningTasks()
+	resp, _ = http.Get(server.URL + "/tasks/" + t.ID.String() + "/stats")
+	if resp.StatusCode != http.StatusNotFound {
+		test.Fatalf("Expected no stats for a completed task, got status %d", resp.StatusCode)
+	}
+}
+
+func TestMetrics(test *testing.T) {
+	w := newWorker()
+	w.Name = "worker-1"
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	w.AddTask(newTask(1))
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error starting task: %v", result.Error)
+	}
+	w.AddTask(newTask(2))
+	w.collectStats()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		test.Fatalf("Error getting metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, expected := range []string{
+		`cube_worker_tasks{state="Running"} 1`,
+		`cube_worker_tasks{state="Failed"} 0`,
+		`cube_worker_queued_tasks 1`,
+		`cube_node_tasks{node="worker-1"} 1`,
+		`cube_node_memory_total_bytes{node="worker-1"}`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			test.Fatalf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestStatsHistory(test *testing.T) {
+	w := newWorker()
+	w.History, _ = stats.NewHistory(time.Second, time.Hour)
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	w.collectStats()
+	w.collectStats()
+
+	resp, err := http.Get(server.URL + "/stats?step=1h")
+	if err != nil {
+		test.Fatalf("Error getting stats history: %v", err)
+	}
+	var points []stats.Point
+	json.NewDecoder(resp.Body).Decode(&points)
+	if resp.StatusCode != http.StatusOK || len(points) == 0 {
+		test.Fatalf("Unexpected history %v with status %d", points, resp.StatusCode)
+	}
+	samples := 0
+	for _, p := range points {
+		samples += p.Samples
+	}
+	if samples != 2 {
+		test.Fatalf("Expected 2 samples, got %d", samples)
+	}
+
+	resp, _ = http.Get(server.URL + "/stats")
+	current := stats.Stats{}
+	json.NewDecoder(resp.Body).Decode(&current)
+	if current.MemStats == nil {
+		test.Fatalf("Expected current stats, got %v", current)
+	}
+
+	resp, _ = http.Get(server.URL + "/stats?since=yesterday")
+	if resp.StatusCode != http.StatusBadRequest {
+		test.Fatalf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestRunTasksOnEnqueue(test *testing.T) {
+	w := newWorker()
+	w.RunPeriod = time.Hour
+	w.wake = loop.NewSignal()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.RunTasks(ctx)
+		close(done)
+	}()
+
+	t := newTask(1)
+	w.AddTask(t)
+	deadline := time.Now().Add(time.Second)
+	for {
+		persisted, err := w.Db.Get(t.ID.String())
+		if err == nil && persisted.State == task.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			test.Fatalf("Expected task to start without waiting for the run period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		test.Fatalf("Expected RunTasks to return once the context is done")
+	}
+}
+
+func TestConcurrentTasks(test *testing.T) {
+	w := newWorker()
+	rt := w.Runtime.(*task.FakeRuntime)
+	release := make(chan struct{})
+	rt.PullHook = func(image string) {
+		if image == "slow" {
+			<-release
+		}
+	}
+
+	slow, fast := newTask(1), newTask(2)
+	slow.Image = "slow"
+	w.AddTask(slow)
+	stop := slow
+	stop.State = task.Completed
+	w.AddTask(stop)
+	w.AddTask(fast)
+
+	e := newExecutor(2)
+	w.runQueuedTasks(e)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		persisted, err := w.Db.Get(fast.ID.String())
+		if err == nil && persisted.State == task.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			test.Fatalf("Expected task to start while another one is pulling")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	e.wait()
+	persisted, _ := w.Db.Get(slow.ID.String())
+	if persisted.State != task.Completed {
+		test.Fatalf("Expected slow task to be started then stopped, got state %v", persisted.State)
+	}
+	if _, ok := rt.Container(persisted.ContainerID); ok {
+		test.Fatalf("Expected container %s to be removed", persisted.ContainerID)
+	}
+}
+
+func TestExecutorBlocksWhenBusy(test *testing.T) {
+	e := newExecutor(1)
+	release := make(chan struct{})
+	first := newTask(1)
+	e.submit(first, func(task.Task) { <-release })
+	// Events of a task being worked on wait in its backlog.
+	e.submit(first, func(task.Task) {})
+
+	submitted := make(chan struct{})
+	go func() {
+		e.submit(newTask(2), func(task.Task) {})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		test.Fatalf("Expected submit to block while all slots are busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-submitted
+	e.wait()
+}
+
+func TestExecutorLimitsAndOrders(test *testing.T) {
+	e := newExecutor(3)
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	applied := make(map[uuid.UUID][]int)
+
+	tasks := []task.Task{newTask(1), newTask(2), newTask(3), newTask(4), newTask(5)}
+	for restart := 0; restart < 5; restart++ {
+		for _, t := range tasks {
+			t.RestartCount = restart
+			e.submit(t, func(t task.Task) {
+				mu.Lock()
+				running++
+				maxRunning = max(maxRunning, running)
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				applied[t.ID] = append(applied[t.ID], t.RestartCount)
+				mu.Unlock()
+			})
+		}
+	}
+	e.wait()
+
+	if maxRunning > 3 {
+		test.Fatalf("Expected at most 3 concurrent events, got %d", maxRunning)
+	}
+	for _, t := range tasks {
+		for i, restart := range applied[t.ID] {
+			if restart != i {
+				test.Fatalf("Expected events of task %v in order, got %v", t.Name, applied[t.ID])
+			}
+		}
+	}
+}
+
+func TestConcurrentAccess(test *testing.T) {
+	w := newWorker()
+	w.Name = "worker-1"
+	w.wake = loop.NewSignal()
+	w.RunPeriod, w.UpdatePeriod = 10*time.Millisecond, 10*time.Millisecond
+	w.History, _ = stats.NewHistory(10*time.Millisecond, time.Second)
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	for _, run := range []func(context.Context){w.RunTasks, w.UpdateTasks, w.CollectStats} {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			run(ctx)
+		}()
+	}
+
+	var clients sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := 0; j < 10; j++ {
+				t := newTask(i*10 + j)
+				data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: t})
+				resp, err := http.Post(server.URL+"/tasks", "application/json", bytes.NewBuffer(data))
+				if err != nil {
+					test.Errorf("Error posting task: %v", err)
+					return
+				}
+				resp.Body.Close()
+
+				for _, path := range []string{"/tasks", "/stats", "/stats?step=1s", "/metrics", "/tasks/" + t.ID.String() + "/stats"} {
+					resp, err := http.Get(server.URL + path)
+					if err != nil {
+						test.Errorf("Error getting %s: %v", path, err)
+						return
+					}
+					resp.Body.Close()
+				}
+
+				req, _ := http.NewRequest(http.MethodDelete, server.URL+"/tasks/"+t.ID.String(), nil)
+				resp, err = http.DefaultClient.Do(req)
+				if err != nil {
+					test.Errorf("Error stopping task: %v", err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	clients.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.GetTasks()) != 40 {
+		if time.Now().After(deadline) {
+			test.Fatalf("Expected 40 tasks, got %d", len(w.GetTasks()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	loops.Wait()
+}
+
+func TestTaskLogs(test *testing.T) {
+	w := newWorker()
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := newTask(1)
+	w.AddTask(t)
+	result := w.RunTask()
+	if result.Error != nil {
+		test.Fatalf("Error starting task: %v", result.Error)
+	}
+	w.Runtime.(*task.FakeRuntime).SetLogs(result.ContainerId, "one\ntwo\nthree\n", "oops\n")
+
+	logs := func(query string, accept string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/tasks/"+t.ID.String()+"/logs"+query, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			test.Fatalf("Error getting logs: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := logs("?tail=2", ""); status != http.StatusOK || body != "two\nthree\noops\n" {
+		test.Fatalf("Unexpected logs %q with status %d", body, status)
+	}
+	status, body := logs("?tail=1", "text/event-stream")
+	expected := "event: stdout\ndata: three\n\nevent: stderr\ndata: oops\n\n"
+	if status != http.StatusOK || body != expected {
+		test.Fatalf("Unexpected events %q with status %d", body, status)
+	}
+	if status, _ := logs("?tail=last", ""); status != http.StatusBadRequest {
+		test.Fatalf("Expected status %d, got %d", http.StatusBadRequest, status)
+	}
+
+	t.State = task.Completed
+	w.AddTask(t)
+	w.RunTask()
+	if status, _ := logs("", ""); status != http.StatusNotFound {
+		test.Fatalf("Expected status %d for a removed container, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestExec(test *testing.T) {
+	w := newWorker()
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := newTask(1)
+	w.AddTask(t)
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error starting task: %v", result.Error)
+	}
+	w.Runtime.(*task.FakeRuntime).ExecHandler = func(id string, cmd []string) task.ExecResult {
+		return task.ExecResult{ExitCode: 2, Stdout: strings.Join(cmd, " "), Stderr: "warning"}
+	}
+
+	exec := func(taskID uuid.UUID, cmd ...string) (int, task.ExecResult) {
+		data, _ := json.Marshal(ExecRequest{Cmd: cmd})
+		resp, err := http.Post(server.URL+"/tasks/"+taskID.String()+"/exec", "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			test.Fatalf("Error running exec: %v", err)
+		}
+		defer resp.Body.Close()
+		result := task.ExecResult{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	status, result := exec(t.ID, "ls", "-l")
+	if status != http.StatusOK || result.ExitCode != 2 || result.Stdout != "ls -l" || result.Stderr != "warning" {
+		test.Fatalf("Unexpected exec result %v with status %d", result, status)
+	}
+	if status, _ := exec(t.ID); status != http.StatusBadRequest {
+		test.Fatalf("Expected status %d without a command, got %d", http.StatusBadRequest, status)
+	}
+	if status, _ := exec(uuid.New(), "ls"); status != http.StatusNotFound {
+		test.Fatalf("Expected status %d for an unknown task, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestExecStream(test *testing.T) {
+	w := newWorker()
+	api := Api{Worker: w}
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	t := newTask(1)
+	w.AddTask(t)
+	if result := w.RunTask(); result.Error != nil {
+		test.Fatalf("Error starting task: %v", result.Error)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/tasks/" + t.ID.String() + "/exec/ws?cmd=cat"
+	messages := execSession(test, url, "hello\n")
+	expected := []ExecMessage{{Stream: StdoutStream, Data: "hello\n"}, {Stream: ExitStream}}
+	if len(messages) != 2 || messages[0] != expected[0] || messages[1] != expected[1] {
+		test.Fatalf("Expected %v, got %v", expected, messages)
+	}
+}
+
+// execSession sends input to the interactive exec session at url, closes
+// its input and returns the messages the worker sent back.
+func execSession(test *testing.T, url string, input string) []ExecMessage {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		test.Fatalf("Error connecting to %v: %v", url, err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(ExecMessage{Stream: StdinStream, Data: input})
+	conn.WriteJSON(ExecMessage{Stream: StdinStream, Close: true})
+	var messages []ExecMessage
+	for {
+		msg := ExecMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func startTaskOnWorker(test *testing.T, w *Worker, t task.Task, wg *sync.WaitGroup) {
+	defer wg.Done()
 	fmt.Println("starting task")
 	w.AddTask(t)
-	result := w.runTask()
+	result := w.RunTask()
 	if result.Error != nil {
-		panic(result.Error)
+		test.Errorf("Error starting task: %v", result.Error)
+		return
 	}
 
 	t.ContainerID = result.ContainerId
 	fmt.Printf("task %s is running in container %s\n", t.ID, t.ContainerID)
-	fmt.Println("Sleepy time")
-	time.Sleep(time.Second * 10)
 
 	fmt.Printf("stopping task %s\n", t.ID)
 	t.State = task.Completed
 	w.AddTask(t)
-	result2 := w.runTask()
+	result2 := w.RunTask()
 	if result2.Error != nil {
-		panic(result2.Error)
+		test.Errorf("Error stopping task: %v", result2.Error)
+		return
+	}
+
+	if _, ok := w.Runtime.(*task.FakeRuntime).Container(t.ContainerID); ok {
+		test.Errorf("Expected container %s to be removed", t.ContainerID)
+	}
+}
+
+func getTasks(test *testing.T, url string) []*task.Task {
+	resp, err := http.Get(url + "/tasks")
+	if err != nil {
+		test.Fatalf("Error getting tasks: %v", err)
+	}
+	defer resp.Body.Close()
+	var tasks []*task.Task
+	err = json.NewDecoder(resp.Body).Decode(&tasks)
+	if err != nil {
+		test.Fatalf("Error decoding tasks: %v", err)
+	}
+	return tasks
+}
+
+// runTask queues t, applies it and returns the task as the worker stored it.
+func runTask(test *testing.T, w *Worker, t task.Task) *task.Task {
+	w.AddTask(t)
+	w.RunTask()
+	persisted, err := w.Db.Get(t.ID.String())
+	if err != nil {
+		test.Fatalf("Error getting task %v: %v", t.ID, err)
 	}
-	wg.Done()
+	return persisted
 }
 
-func newWorker() Worker {
-	db := make(map[uuid.UUID]*task.Task)
-	return Worker{
-		Queue: *queue.New(),
-		Db:    db,
+func newWorker() *Worker {
+	return &Worker{
+		Db:      store.NewInMemoryStore[*task.Task](),
+		Runtime: task.NewFakeRuntime(),
 	}
 }
 